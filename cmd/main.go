@@ -12,6 +12,7 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io/ioutil"
 	"os"
 	// 標準パッケージではないので goinstall でインストールします。
 	// goinstall godentaku.googlecode.com/hg/godentaku
@@ -20,39 +21,90 @@ import (
 
 // inから一行づつ読んで、評価して表示します。
 func readEvalPrint(in *bufio.Reader, env *godentaku.Env) (err os.Error) {
-	// deferはこの関数をぬける時に実行するように指示します。
-	// deferはこのようにpanic()/recover()につかったり、
-	// リソースの開放などに使われます。
-	// f, err := os.Open("file", os.O_RDONLY, 0666)
-	// defer f.Close()
-	// func() { .. } は関数リテラル/無名関数です。
-	// func() { .. }() とすることでその関数の実行になります。
-	// 引数があるばあいは func(i int){ .. }(10) のようにかきます。
-	defer func() {
-		// もし途中でpanic()していたらrecover()でつかまえることが
-		// できます。
-		if x := recover(); x != nil {
-			fmt.Println("panic:", x)
-		}
-	}()
-
 	// プロンプトを表示
 	fmt.Printf(">")
 
 	// '\n' まで(つまり1行)よみとり
+	// 最後の行が改行で終わっていないときは、読めた分といっしょに
+	// エラーがかえってくるので、その行を処理してから終わります。
 	line, err := in.ReadBytes('\n')
-	if err != nil {
+	if len(line) == 0 {
 		return err
 	}
-	ast, nbuf := godentaku.Read(line)
-	v := godentaku.Eval(ast, env)
-	fmt.Println(godentaku.Print(v, env))
+	// Try系の関数はpanicせずにエラーをかえすので、recover()しなくても
+	// 入力がまちがっているだけでプログラムが終了することはありません。
+	// エラーはDiagnose()で問題の場所がわかるように表示して、次の行の
+	// 入力にすすみます。
+	// 1 + 2; 3 * 4 のように';'で区切った文はまとめて読みます。
+	stmts, perr := godentaku.TryReadAll(line)
+	// 式の途中で行が終わっていたら、続きの行を読んでつなげてから
+	// もう一度読みます。
+	for godentaku.IsIncomplete(perr) && err == nil {
+		fmt.Printf("..")
+		var next []byte
+		next, err = in.ReadBytes('\n')
+		// 改行はそのまま残してつなげます。# のコメントが次の行まで
+		// つづかないようにするためです。式の途中の改行はパーザが
+		// 読みとばします。
+		line = append(line, next...)
+		stmts, perr = godentaku.TryReadAll(line)
+	}
+	if perr != nil {
+		fmt.Println(godentaku.Diagnose(perr))
+		return err
+	}
+	// 空行ならstmtsは空なので、なにも表示しません。
+	for _, stmt := range stmts {
+		// エラーになったら、その行の残りの文は実行しません。
+		if !evalPrint(stmt, env) {
+			break
+		}
+	}
+	return err
+}
+
+// 文を評価して結果を表示します。エラーになったらfalseをかえします。
+func evalPrint(stmt godentaku.Ast, env *godentaku.Env) bool {
+	v, err := godentaku.TryEval(stmt, env)
+	if err != nil {
+		fmt.Println(godentaku.Diagnose(err))
+		return false
+	}
+	s, err := godentaku.TryPrint(v, env)
+	if err != nil {
+		fmt.Println(godentaku.Diagnose(err))
+		return false
+	}
+	// 代入したときは、式(formula)と値(value)のどちらになったかも
+	// 表示します。
+	if a, ok := stmt.(godentaku.AssignOp); ok {
+		if kind := godentaku.VarKind(env, string(a.Var)); kind != "" {
+			s += " (" + kind + ")"
+		}
+	}
+	fmt.Println(s)
+	return true
+}
 
-	// Readで読みとらなかった残りが改行文字以外だったらwarning。
-	if len(nbuf) > 0 && nbuf[0] != '\n' {
-		fmt.Println("warning: unparsed:", string(nbuf))
+// ファイルに書いた計算を読んで、順に評価して表示します。
+// エラーになったらそこで終わります。
+func runScript(filename string, env *godentaku.Env) bool {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
 	}
-	return nil
+	stmts, err := godentaku.TryReadAll(b)
+	if err != nil {
+		fmt.Println(godentaku.Diagnose(err))
+		return false
+	}
+	for _, stmt := range stmts {
+		if !evalPrint(stmt, env) {
+			return false
+		}
+	}
+	return true
 }
 
 // main関数がプログラムのエントリーです。
@@ -66,6 +118,18 @@ func main() {
 	godentaku.SetFunc(env, "dump", godentaku.DumpAst)
 	godentaku.SetFunc(env, "print", godentaku.PrintAst)
 
+	// godentaku calc.gdt のようにファイルの名前をわたすと、REPLの
+	// かわりにファイルの計算をします。
+	// os.Args[0]はコマンドの名前です。
+	if len(os.Args) > 1 {
+		for _, filename := range os.Args[1:] {
+			if !runScript(filename, env) {
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
 	// REPL: Read-eval-print loop
 	// このようにforループをかくと無限ループになります。
 	for {
@@ -0,0 +1,100 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"big"
+)
+
+// ビット演算の演算子かどうか。
+//  &  AND       |  OR        ^  XOR
+//  &^ AND NOT   << 左シフト  >> 右シフト
+func isBitOp(op string) bool {
+	switch op {
+	case "&", "|", "^", "&^", "<<", ">>":
+		return true
+	}
+	return false
+}
+
+// 整数l, rのビット演算をします。
+// 負の数は、無限に1がつづく2の補数としてあつかいます。
+// Fixedは型の幅の2の補数です。
+func bitCalc(e BinOp, l, r Ast, env *Env) Ast {
+	for _, v := range []Ast{l, r} {
+		if _, ok := v.(Fixed); !ok && !isInteger(v) {
+			panic(newError(TypeError, e.Pos,
+				"bitwise operation on non-integer", e.String()))
+		}
+	}
+	a := toBig(l)
+	z := new(big.Int)
+	switch e.Op {
+	case "<<", ">>":
+		// シフトの結果は左辺の型になります。右辺の型はなんでも
+		// かまいません。
+		n := shiftCount(e, r)
+		if f, ok := l.(Fixed); ok && n >= f.Type.Bits {
+			// 型の幅より大きくシフトすると、のこるbitはありません。
+			// 負の数の算術右シフトだけはすべてのbitが1になります。
+			if e.Op == ">>" && a.Sign() < 0 {
+				return Fixed{f.Type, wrapBits(f.Type, big.NewInt(-1))}
+			}
+			return Fixed{f.Type, 0}
+		}
+		if e.Op == "<<" && a.Sign() != 0 &&
+			uint64(a.BitLen())+uint64(n) > maxBits {
+			// 大きすぎる数はpowCalc()とおなじように作りません。
+			panic(newError(ValueError, e.Pos, "result too large", e.String()))
+		}
+		if e.Op == "<<" {
+			z.Lsh(a, n)
+		} else {
+			// 負の数は -Inf の方向に丸める算術シフトです。
+			z.Rsh(a, n)
+		}
+		if f, ok := l.(Fixed); ok {
+			// ハードウェアとおなじように、はみだしたbitは
+			// .overflowによらず捨てます。
+			return Fixed{f.Type, wrapBits(f.Type, z)}
+		}
+		return intResult(z)
+	case "&":
+		z.And(a, toBig(r))
+	case "|":
+		z.Or(a, toBig(r))
+	case "^":
+		z.Xor(a, toBig(r))
+	case "&^":
+		z.AndNot(a, toBig(r))
+	}
+	if numRank(l) == fixedRank || numRank(r) == fixedRank {
+		return toFixed(fixedType(e, l, r), z, e.Pos, e.String(), env)
+	}
+	return intResult(z)
+}
+
+// シフトする数をかえします。0以上のintでなければいけません。
+func shiftCount(e BinOp, r Ast) uint {
+	n, ok := intResult(toBig(r)).(Num)
+	if !ok || n < 0 {
+		panic(newError(ValueError, e.Pos,
+			"bad shift count "+r.String(), e.String()))
+	}
+	return uint(n)
+}
+
+// 整数vのビットを反転します。~x は -x-1 とおなじです。
+func complement(e UnaryOp, v Ast) Ast {
+	switch n := v.(type) {
+	case Num:
+		return Num(^int(n))
+	case BigNum:
+		return intResult(new(big.Int).Not(n.Int))
+	case Fixed:
+		return Fixed{n.Type, wrapBits(n.Type, new(big.Int).Not(n.Int()))}
+	}
+	panic(newError(TypeError, e.Pos,
+		"bitwise operation on non-integer", e.String()))
+}
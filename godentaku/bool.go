@@ -0,0 +1,123 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+// 真偽値をAstインターフェイスをみたすBool型として定義します。
+// true, false と書くか、1 < 2 のような比較の結果になります。
+type Bool bool
+
+func (b Bool) String() string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+func (b Bool) Eval(_ *Env) Ast {
+	return b
+}
+
+// 比較の演算子かどうか。
+func isCompareOp(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+// 数値l, rを比較します。
+// 型がちがっても値で比較するので 1 == 1.0 はtrueです。Floatは
+// IEEE-754のとおり、NaNは何と比較してもfalseです(!=だけtrue)。
+// 複素数は == と != でしか比較できません。
+func compare(e BinOp, l, r Ast, env *Env) Ast {
+	rank := numRank(l)
+	if numRank(r) > rank {
+		rank = numRank(r)
+	}
+	var c int // l < r なら-1, l == r なら0, l > r なら1
+	switch rank {
+	case intRank, bigRank:
+		c = toBig(l).Cmp(toBig(r))
+	case ratRank, decRank:
+		c = toRat(l).Cmp(toRat(r))
+	case floatRank:
+		a, b := toFloat(l), toFloat(r)
+		switch {
+		case a != a || b != b: // NaN
+			return Bool(e.Op == "!=")
+		case a < b:
+			c = -1
+		case a > b:
+			c = 1
+		}
+	case cmplxRank:
+		if e.Op != "==" && e.Op != "!=" {
+			panic(newError(TypeError, e.Pos,
+				"complex numbers are not ordered", e.String()))
+		}
+		return Bool((toComplex(l) == toComplex(r)) == (e.Op == "=="))
+	case fixedRank:
+		fixedType(e, l, r)
+		c = toBig(l).Cmp(toBig(r))
+	}
+	switch e.Op {
+	case "==":
+		return Bool(c == 0)
+	case "!=":
+		return Bool(c != 0)
+	case "<":
+		return Bool(c < 0)
+	case "<=":
+		return Bool(c <= 0)
+	case ">":
+		return Bool(c > 0)
+	case ">=":
+		return Bool(c >= 0)
+	}
+	panic(newError(TypeError, e.Pos,
+		"unsupported binOp:"+e.Op, e.String()))
+}
+
+// Boolをふくむ二項演算です。Boolどうしの == と != だけができます。
+func boolCalc(e BinOp, l, r Ast) Ast {
+	a, lok := l.(Bool)
+	b, rok := r.(Bool)
+	if lok && rok {
+		switch e.Op {
+		case "==":
+			return Bool(a == b)
+		case "!=":
+			return Bool(a != b)
+		}
+	}
+	panic(newError(TypeError, e.Pos,
+		"unsupported binOp:"+e.Op, e.String()))
+}
+
+// && と || を評価します。
+// 左辺で結果がきまるときは右辺を評価しません(short-circuit)。
+//  false && x は false、true || x は true です。
+// 未定義のSymbolをふくむときはBinOpのままかえします。
+func logicCalc(e BinOp, env *Env) Ast {
+	l := e.Left.Eval(env)
+	// 値なのにBoolでなければエラーです。値でなければ未定義のSymbolを
+	// ふくむ式です。
+	if _, ok := l.(Bool); !ok && isValue(l) {
+		panic(newError(TypeError, e.Pos,
+			"non-boolean operand "+l.String(), e.String()))
+	}
+	if b, ok := l.(Bool); ok && bool(b) == (e.Op == "||") {
+		return b
+	}
+	r := e.Right.Eval(env)
+	if _, ok := r.(Bool); !ok && isValue(r) {
+		panic(newError(TypeError, e.Pos,
+			"non-boolean operand "+r.String(), e.String()))
+	}
+	if _, ok := l.(Bool); ok {
+		// true && r と false || r は r です。
+		return r
+	}
+	return BinOp{Op: e.Op, Left: l, Right: r, Pos: e.Pos}
+}
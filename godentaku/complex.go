@@ -0,0 +1,166 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"big"
+	"cmath"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// 複素数をAstインターフェイスをみたすComplex型として定義します。
+// 4i のように数値のあとに i をつけると虚数になるので、3+4i のように
+// 書けます。
+type Complex complex128
+
+func (c Complex) String() string {
+	return "(" + rectString(complex128(c), -1) + ")"
+}
+func (c Complex) Eval(_ *Env) Ast {
+	return c
+}
+
+// 3+4i の形の文字列にします。precはFloatの有効桁数です。
+func rectString(c complex128, prec int) string {
+	im := strconv.Ftoa64(imag(c), 'g', prec)
+	if im[0] != '-' && im[0] != '+' {
+		im = "+" + im
+	}
+	return strconv.Ftoa64(real(c), 'g', prec) + im + "i"
+}
+
+// 数値をcomplex128にします。
+func toComplex(v Ast) complex128 {
+	if c, ok := v.(Complex); ok {
+		return complex128(c)
+	}
+	return complex(toFloat(v), 0)
+}
+
+// complex128で計算します。
+func complexCalc(e BinOp, a, b complex128) complex128 {
+	switch e.Op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	}
+	panic(newError(TypeError, e.Pos,
+		fmt.Sprintf("unsupported binOp:%s", e.Op), e.String()))
+}
+
+// Complexを.printComplexの設定にしたがって文字列にします。
+//  rect   3+4i (default)
+//  polar  5∠0.9272952180016122 (絶対値∠偏角)
+func printComplex(c Complex, env *Env) string {
+	prec := envValueOr(env, ".printPrecision", -1)
+	if prec < -1 {
+		panic(badSetting(env, ".printPrecision"))
+	}
+	mode := envSymbolOr(env, ".printComplex", "rect")
+	switch mode {
+	case "rect":
+		return rectString(complex128(c), prec)
+	case "polar":
+		r, theta := cmath.Polar(complex128(c))
+		return strconv.Ftoa64(r, 'g', prec) + "∠" +
+			strconv.Ftoa64(theta, 'g', prec)
+	}
+	panic(badSetting(env, ".printComplex"))
+}
+
+// 引数を評価して数値ならfを、未定義のSymbolをふくむときは関数呼出の
+// ままかえす関数を作ります。数値でない値ならエラーです。
+func mathFunc(name string, f func(Ast, *Env) Ast) func(Ast, *Env) Ast {
+	return func(arg Ast, env *Env) Ast {
+		v := arg.Eval(env)
+		checkNumber(name, v)
+		if !isValue(v) {
+			return deferCall(name, v)
+		}
+		return f(v, env)
+	}
+}
+
+// 実数の符号をかえします。
+func sign(v Ast) int {
+	switch n := v.(type) {
+	case Num:
+		switch {
+		case n > 0:
+			return 1
+		case n < 0:
+			return -1
+		}
+		return 0
+	case BigNum:
+		return n.Sign()
+	case Rational:
+		return n.Sign()
+	case Decimal:
+		return n.Unscaled.Sign()
+	case Fixed:
+		return n.Int().Sign()
+	case Float:
+		switch {
+		case n > 0:
+			return 1
+		case n < 0:
+			return -1
+		}
+		return 0
+	}
+	panic(newError(TypeError, PosOf(v), "not real number", v.String()))
+}
+
+// re(x): 実部
+func reFunc(v Ast, _ *Env) Ast {
+	if c, ok := v.(Complex); ok {
+		return Float(real(c))
+	}
+	return v
+}
+
+// im(x): 虚部
+func imFunc(v Ast, _ *Env) Ast {
+	if c, ok := v.(Complex); ok {
+		return Float(imag(c))
+	}
+	return Num(0)
+}
+
+// abs(x): 絶対値。実数なら型はそのままです。
+func absFunc(v Ast, env *Env) Ast {
+	switch n := v.(type) {
+	case Complex:
+		return Float(cmath.Abs(complex128(n)))
+	case Float:
+		return Float(math.Fabs(float64(n)))
+	case Decimal:
+		return Decimal{new(big.Int).Abs(n.Unscaled), n.Scale}
+	}
+	if sign(v) < 0 {
+		return negate(UnaryOp{Op: "-", Expr: v, Pos: PosOf(v)}, v, env)
+	}
+	return v
+}
+
+// arg(x): 偏角(ラジアン)
+func argFunc(v Ast, _ *Env) Ast {
+	return Float(cmath.Phase(toComplex(v)))
+}
+
+// conj(x): 共役複素数
+func conjFunc(v Ast, _ *Env) Ast {
+	if c, ok := v.(Complex); ok {
+		return Complex(cmath.Conj(complex128(c)))
+	}
+	return v
+}
@@ -0,0 +1,378 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"big"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 10進数の小数をAstインターフェイスをみたすDecimal型として定義します。
+// 値は Unscaled × 10^-Scale です。たとえば 0.25 は {25, 2} になります。
+// Floatとちがって 0.1 のような10進数の小数を誤差なしにあらわせるので、
+// お金の計算などに使います。
+//
+// 3.14 のような小数の入力はいったんDecimalとして読んでおいて、評価する
+// ときに .decimal が0ならFloatに、0以外ならDecimalのまま計算します。
+// 計算結果の小数点以下が .decimalScale 桁より長くなったときは .rounding の
+// 方法で丸めます。
+type Decimal struct {
+	Unscaled *big.Int
+	Scale    int
+}
+
+func (d Decimal) String() string {
+	if d.Scale <= 0 {
+		return d.Unscaled.String() + strings.Repeat("0", -d.Scale)
+	}
+	s := new(big.Int).Abs(d.Unscaled).String()
+	if len(s) <= d.Scale {
+		s = strings.Repeat("0", d.Scale-len(s)+1) + s
+	}
+	sign := ""
+	if d.Unscaled.Sign() < 0 {
+		sign = "-"
+	}
+	i := len(s) - d.Scale
+	return sign + s[:i] + "." + s[i:]
+}
+func (d Decimal) Eval(env *Env) Ast {
+	if !Defined(env, ".decimal") {
+		return Float(toFloat(d))
+	}
+	return d
+}
+
+// 10のn乗をかえします。
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// 10進数の小数の文字列 "1.25", "6.02e23" をDecimalにします。
+// 指数が大きすぎるときは、位置のないSyntaxErrorでpanicします。
+func parseDecimal(s string) Decimal {
+	text := s
+	exp := 0
+	if i := strings.Index(strings.ToLower(s), "e"); i >= 0 {
+		var err os.Error
+		// 1e99999999999999999999 のようにintにおさまらないと
+		// エラーになります。
+		if exp, err = strconv.Atoi(s[i+1:]); err != nil {
+			panic(newError(SyntaxError, Pos{}, "bad exponent", text))
+		}
+		s = s[:i]
+	}
+	scale := 0
+	if i := strings.Index(s, "."); i >= 0 {
+		scale = len(s) - i - 1
+		s = s[:i] + s[i+1:]
+	}
+	// 1e9999999999 のDecimalを文字列にすると、0がたくさんならんで
+	// メモリが足りなくなるので、指数の大きさを制限します。
+	// 1e-9223372036854775808 の scale-exp はintからあふれるので、
+	// 引き算する前にexpだけでも調べておきます。
+	if exp > maxBits || exp < -maxBits ||
+		scale-exp > maxBits || exp-scale > maxBits {
+		panic(newError(SyntaxError, Pos{}, "exponent too large", text))
+	}
+	x, _ := new(big.Int).SetString("0"+s, 10)
+	return Decimal{x, scale - exp}
+}
+
+// 丸めの方法です。.roundingに名前で設定します。
+var roundingModes = []string{
+	"halfeven", // 最近接、ちょうど半分なら偶数へ(銀行家の丸め)
+	"halfup",   // 四捨五入、ちょうど半分なら0から遠いほうへ
+	"halfdown", // 五捨六入、ちょうど半分なら0に近いほうへ
+	"down",     // 0の方向へ(切り捨て)
+	"up",       // 0から遠い方向へ(切り上げ)
+	"floor",    // -Infの方向へ
+	"ceiling",  // +Infの方向へ
+}
+
+// .roundingの設定を読みます。
+func roundingMode(env *Env) string {
+	mode := envSymbolOr(env, ".rounding", "halfeven")
+	for _, m := range roundingModes {
+		if m == mode {
+			return mode
+		}
+	}
+	panic(badSetting(env, ".rounding"))
+}
+
+// .decimalScaleの設定を読みます。
+func decimalScale(env *Env) int {
+	scale := envValueOr(env, ".decimalScale", 20)
+	if scale < 0 {
+		panic(badSetting(env, ".decimalScale"))
+	}
+	return scale
+}
+
+// n/dをmodeの方法で丸めて整数にします。
+func roundQuo(n, d *big.Int, mode string) *big.Int {
+	q, r := new(big.Int).QuoRem(n, d, new(big.Int))
+	if r.Sign() == 0 {
+		return q
+	}
+	// 商の符号です。QuoRemは0の方向に切り捨てています。
+	sign := n.Sign() * d.Sign()
+	// あまりの2倍と割る数をくらべて、半分より大きいかどうか調べます。
+	r2 := new(big.Int).Abs(r)
+	cmp := r2.Lsh(r2, 1).Cmp(new(big.Int).Abs(d))
+	away := false // 0から遠いほうに丸めるかどうか
+	switch mode {
+	case "halfeven":
+		odd := new(big.Int).Rem(q, big.NewInt(2)).Sign() != 0
+		away = cmp > 0 || (cmp == 0 && odd)
+	case "halfup":
+		away = cmp >= 0
+	case "halfdown":
+		away = cmp > 0
+	case "up":
+		away = true
+	case "floor":
+		away = sign < 0
+	case "ceiling":
+		away = sign > 0
+	}
+	if away {
+		q.Add(q, big.NewInt(int64(sign)))
+	}
+	return q
+}
+
+// dを小数点以下scale桁にします。桁がへるときはmodeで丸めます。
+func rescale(d Decimal, scale int, mode string) Decimal {
+	if scale >= d.Scale {
+		x := new(big.Int).Mul(d.Unscaled, pow10(scale-d.Scale))
+		return Decimal{x, scale}
+	}
+	return Decimal{roundQuo(d.Unscaled, pow10(d.Scale-scale), mode), scale}
+}
+
+// 数値をDecimalにします。
+// 割り切れない分数は小数点以下.decimalScale桁に丸めます。
+func toDecimal(v Ast, env *Env) Decimal {
+	switch n := v.(type) {
+	case Num, BigNum:
+		return Decimal{toBig(n), 0}
+	case Rational:
+		scale := decimalScale(env)
+		x := new(big.Int).Mul(n.Num(), pow10(scale))
+		return Decimal{roundQuo(x, n.Denom(), roundingMode(env)), scale}
+	case Decimal:
+		return n
+	}
+	panic(newError(TypeError, PosOf(v), "not decimal", v.String()))
+}
+
+// Decimalで計算します。
+func decCalc(e BinOp, a, b Decimal, env *Env) Decimal {
+	scale, mode := decimalScale(env), roundingMode(env)
+	var z Decimal
+	switch e.Op {
+	case "+", "-", "%":
+		// 小数点の位置をそろえてから計算します。
+		s := a.Scale
+		if b.Scale > s {
+			s = b.Scale
+		}
+		a, b = rescale(a, s, mode), rescale(b, s, mode)
+		z = Decimal{new(big.Int), s}
+		switch e.Op {
+		case "+":
+			z.Unscaled.Add(a.Unscaled, b.Unscaled)
+		case "-":
+			z.Unscaled.Sub(a.Unscaled, b.Unscaled)
+		case "%":
+			if b.Unscaled.Sign() == 0 {
+				panic(newError(DivisionError, e.Pos,
+					"division by zero", e.String()))
+			}
+			z.Unscaled.Rem(a.Unscaled, b.Unscaled)
+		}
+	case "*":
+		// 小数点の位置は a.Scale + b.Scale になります。1e4000000 を
+		// なんども掛けると指数がどんどん大きくなるので、decPow()と
+		// おなじように大きすぎる結果はエラーにします。
+		s := a.Scale + b.Scale
+		if s > maxBits || s < -maxBits {
+			panic(newError(ValueError, e.Pos, "result too large",
+				e.String()))
+		}
+		z = Decimal{new(big.Int).Mul(a.Unscaled, b.Unscaled), s}
+	case "/":
+		if b.Unscaled.Sign() == 0 {
+			panic(newError(DivisionError, e.Pos,
+				"division by zero", e.String()))
+		}
+		// (a.U / 10^a.S) / (b.U / 10^b.S) を小数点以下scale桁で
+		// もとめるので、a.U × 10^(b.S + scale - a.S) / b.U を丸めます。
+		n, d := a.Unscaled, b.Unscaled
+		if p := b.Scale + scale - a.Scale; p >= 0 {
+			n = new(big.Int).Mul(n, pow10(p))
+		} else {
+			d = new(big.Int).Mul(d, pow10(-p))
+		}
+		z = Decimal{roundQuo(n, d, mode), scale}
+		// 10/4 が 2.50000... にならないように、割り切れたときは
+		// 後ろの0をとります。ただし 1.00/2 が 0.50 になるように
+		// a.Scale - b.Scale 桁はのこします。
+		ten, m := big.NewInt(10), new(big.Int)
+		for z.Scale > 0 && z.Scale > a.Scale-b.Scale {
+			q, _ := new(big.Int).QuoRem(z.Unscaled, ten, m)
+			if m.Sign() != 0 {
+				break
+			}
+			z = Decimal{q, z.Scale - 1}
+		}
+		return z
+	default:
+		panic(newError(TypeError, e.Pos,
+			fmt.Sprintf("unsupported binOp:%s", e.Op), e.String()))
+	}
+	if z.Scale > scale {
+		z = rescale(z, scale, mode)
+	}
+	return z
+}
+
+// 数値vを整数に丸めます。Floatの結果はFloatのままです。
+func roundNumber(v Ast, mode string) Ast {
+	switch n := v.(type) {
+	case Num, BigNum, Fixed:
+		return n
+	case Rational:
+		return intResult(roundQuo(n.Num(), n.Denom(), mode))
+	case Decimal:
+		if n.Scale <= 0 {
+			return intResult(rescale(n, 0, mode).Unscaled)
+		}
+		return intResult(roundQuo(n.Unscaled, pow10(n.Scale), mode))
+	case Float:
+		return Float(roundFloat(float64(n), mode))
+	}
+	panic(newError(TypeError, PosOf(v), "not number", v.String()))
+}
+
+// float64をmodeの方法で丸めます。
+func roundFloat(f float64, mode string) float64 {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return f
+	}
+	t := math.Floor(math.Fabs(f)) // 0の方向に切り捨てた絶対値
+	frac := math.Fabs(f) - t
+	away := false
+	switch mode {
+	case "halfeven":
+		away = frac > 0.5 || (frac == 0.5 && math.Fmod(t, 2) == 1)
+	case "halfup":
+		away = frac >= 0.5
+	case "halfdown":
+		away = frac > 0.5
+	case "up":
+		away = frac > 0
+	case "floor":
+		away = f < 0 && frac > 0
+	case "ceiling":
+		away = f > 0 && frac > 0
+	}
+	if away {
+		t++
+	}
+	if f < 0 {
+		return -t
+	}
+	return t
+}
+
+// 数値vを小数点以下digits桁に丸めます。digitsが負なら10の位や100の
+// 位に丸めます。
+//  round(2.345, 2) = 2.35  round(1234, -2) = 1200
+// DecimalとFloatはそのままの型で、整数と分数は分数か整数になります。
+func roundDigits(v Ast, digits int, mode string, env *Env) Ast {
+	switch n := v.(type) {
+	case Decimal:
+		if digits >= n.Scale {
+			return n
+		}
+		return rescale(n, digits, mode)
+	case Float:
+		p := math.Pow(10, float64(digits))
+		x := float64(n) * p
+		switch {
+		case p == 0:
+			// round(2.5, -400) の10**-400は0になってしまいます。
+			// どんな有限の値も10**400の位で丸めると0です。
+			return Float(math.Copysign(0, float64(n)))
+		case math.IsInf(p, 0) || math.IsInf(x, 0) || n == 0:
+			// round(2.5, 400) のようにfloat64の精度より細かい桁
+			// なら、丸めてもかわりません。
+			return n
+		}
+		return Float(roundFloat(x, mode) / p)
+	case Fixed:
+		if digits >= 0 {
+			return n
+		}
+		x := roundDigits(intResult(n.Int()), digits, mode, env)
+		return toFixed(n.Type, toBig(x), Pos{}, "", env)
+	case Num, BigNum, Rational:
+		if digits >= 0 && isInteger(v) {
+			return v
+		}
+		// 10**digits倍して整数に丸めてから、10**digitsで割ります。
+		d := digits
+		if d < 0 {
+			d = -d
+		}
+		scale := new(big.Rat).SetInt(pow10(d))
+		x := new(big.Rat)
+		if digits >= 0 {
+			x.Mul(toRat(v), scale)
+		} else {
+			x.Quo(toRat(v), scale)
+		}
+		x.SetInt(roundQuo(x.Num(), x.Denom(), mode))
+		if digits >= 0 {
+			x.Quo(x, scale)
+		} else {
+			x.Mul(x, scale)
+		}
+		return ratResult(x)
+	}
+	panic(newError(TypeError, PosOf(v), "not number", v.String()))
+}
+
+// 丸めの関数を作ります。modeが""なら.roundingの設定を使います。
+// 2つめの引数があれば、小数点以下その桁数に丸めます。
+//  round(x)  round(x, 2)
+func roundFunc(name, mode string) func([]Ast, *Env) Ast {
+	return mathFuncN(name, 1, 2, func(args []Ast, env *Env) Ast {
+		m := mode
+		if m == "" {
+			m = roundingMode(env)
+		}
+		if len(args) == 1 {
+			return roundNumber(args[0], m)
+		}
+		digits, ok := args[1].(Num)
+		if !ok {
+			panic(newError(TypeError, Pos{}, name+": digits must be integer",
+				args[1].String()))
+		}
+		// 10**digitsが大きくなりすぎないようにします。
+		if digits > maxBits/4 || digits < -maxBits/4 {
+			panic(newError(ValueError, Pos{}, name+": too many digits",
+				args[1].String()))
+		}
+		return roundDigits(args[0], int(digits), m, env)
+	})
+}
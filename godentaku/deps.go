@@ -0,0 +1,349 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"sort"
+)
+
+// x = y + z のように式を代入すると、xはyとzに依存します。
+// 一番親のEnvのdepsに、変数ごとに式の中で使っている変数の名前を
+// おぼえておきます。表計算のセルのように、yを代入しなおすとxの値も
+// かわります。
+// x = g(y) のように定義した関数を呼んでいれば、xはgの本体で使っている
+// 変数にも依存します。呼んでいる関数の名前はcallsにおぼえておいて、
+// gを定義しなおしたときもxの値がかわったことを知らせます。
+
+// 式astの中で使っている変数の名前を、出てきた順にかえします。
+// letやLambdaの引数の名前は外の変数ではないのでふくみません。
+// 定義されている関数の名前もふくみません。
+// 定義した関数を呼んでいれば、その本体で使っている変数もふくみます。
+//  rate = 2; g(n) = n * rate; x = g(3)
+// のxはrateをかえるとかわるからです。
+func freeVars(env *Env, ast Ast) []string {
+	vars, _ := refs(env, ast)
+	return vars
+}
+
+// 式astの中で使っている変数の名前と、呼んでいる関数の名前を、
+// 出てきた順にかえします。
+// 定義した関数の本体もたどるので、関数の中で呼んでいる関数の名前も
+// ふくみます。関数の本体は一番親のEnvで評価するので、本体の中では
+// 関数の引数の名前だけが外の変数ではありません。
+func refs(env *Env, ast Ast) (vars, funcs []string) {
+	seen := make(map[string]bool)
+	called := make(map[string]bool)
+	var walk func(a Ast, bound map[string]bool)
+	walk = func(a Ast, bound map[string]bool) {
+		switch a := a.(type) {
+		case Atom:
+			walk(a.Value, bound)
+		case Symbol:
+			name := string(a)
+			if !bound[name] && !seen[name] {
+				seen[name] = true
+				vars = append(vars, name)
+			}
+		case UnaryOp:
+			walk(a.Expr, bound)
+		case BinOp:
+			walk(a.Left, bound)
+			walk(a.Right, bound)
+		case IfExpr:
+			walk(a.Cond, bound)
+			walk(a.Then, bound)
+			walk(a.Else, bound)
+		case FunCall:
+			name := string(a.Func)
+			switch {
+			case bound[name]:
+			case !called[name]:
+				// まだ定義していない関数も、あとで定義したときに
+				// 知らせられるようにおぼえておきます。
+				// fact(n) のように自分を呼ぶ関数は一度だけたどります。
+				called[name] = true
+				funcs = append(funcs, name)
+				if d, ok := env.Def[name]; ok {
+					walk(d.Body, bind(map[string]bool{}, d.Params))
+				}
+			}
+			if !isFunc(env, name) {
+				walk(a.Func, bound)
+			}
+			for _, arg := range a.Args {
+				walk(arg, bound)
+			}
+		case List:
+			for _, e := range a {
+				walk(e, bound)
+			}
+		case Lambda:
+			walk(a.Body, bind(bound, a.Params))
+		case LetExpr:
+			// 前の変数は後の式から見えます。
+			for i, e := range a.Exprs {
+				walk(e, bind(bound, a.Names[:i]))
+			}
+			walk(a.Body, bind(bound, a.Names))
+		}
+	}
+	walk(ast, map[string]bool{})
+	return vars, funcs
+}
+
+// 式astが変数も関数呼出も使っていない定数の式かどうか。
+// g(1) や x -> x * 2 は、あとで g を定義しなおしたり、Closureの中で
+// 変数を使っていたりすると値がかわるので定数ではありません。
+func isConstant(env *Env, ast Ast) bool {
+	if len(freeVars(env, ast)) > 0 {
+		return false
+	}
+	var walk func(a Ast) bool
+	walk = func(a Ast) bool {
+		switch a := a.(type) {
+		case Atom:
+			return walk(a.Value)
+		case UnaryOp:
+			return walk(a.Expr)
+		case BinOp:
+			return walk(a.Left) && walk(a.Right)
+		case IfExpr:
+			return walk(a.Cond) && walk(a.Then) && walk(a.Else)
+		case FunCall, Lambda, Closure:
+			return false
+		case List:
+			for _, e := range a {
+				if !walk(e) {
+					return false
+				}
+			}
+		case LetExpr:
+			for _, e := range a.Exprs {
+				if !walk(e) {
+					return false
+				}
+			}
+			return walk(a.Body)
+		}
+		return true
+	}
+	return walk(ast)
+}
+
+// boundにnamesを加えたmapを作ります。boundはかえません。
+func bind(bound map[string]bool, names []Symbol) map[string]bool {
+	m := make(map[string]bool)
+	for k := range bound {
+		m[k] = true
+	}
+	for _, name := range names {
+		m[string(name)] = true
+	}
+	return m
+}
+
+// nameが組込みの関数か、定義した関数の名前かどうか。
+func isFunc(env *Env, name string) bool {
+	_, isFunc := env.Func[name]
+	_, isFuncN := env.FuncN[name]
+	_, isDef := env.Def[name]
+	return isFunc || isFuncN || isDef
+}
+
+// 変数nameの式をexprにしたときの依存をおぼえます。
+// exprがnilのときは、値を代入したか削除したので依存はなくなります。
+// 一番親のEnvの変数だけをあつかいます。
+func setDeps(env *Env, name string, expr Ast) {
+	if env.Parent != nil {
+		return
+	}
+	ensureMaps(env)
+	if expr == nil {
+		env.deps[name] = nil, false
+		env.calls[name] = nil, false
+		return
+	}
+	env.deps[name], env.calls[name] = refs(env, expr)
+}
+
+// 関数を定義しなおしたり削除したりすると、関数の本体で使っている
+// 変数がかわるので、式を代入した変数の依存をすべておぼえなおします。
+func refreshDeps(env *Env) {
+	root := rootEnv(env)
+	ensureMaps(root)
+	for name := range root.deps {
+		if expr, found := root.Var[name]; found {
+			setDeps(root, name, expr)
+		}
+	}
+}
+
+// 変数nameを式の中で直接使っている変数と、関数nameを呼んでいる変数の
+// 名前を、ソートしてかえします。
+func dependents(env *Env, name string) []string {
+	var names []string
+	root := rootEnv(env)
+	for v, deps := range root.deps {
+		if contains(deps, name) || contains(root.calls[v], name) {
+			names = append(names, v)
+		}
+	}
+	sort.SortStrings(names)
+	return names
+}
+
+// namesにnameがあるかどうか。
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// nameを代入しなおしたり、関数nameを定義しなおしたりしたときに値が
+// かわるかもしれない変数です。
+// name自身と、依存をたどってnameを使っている変数すべてを、近い順に
+// かえします。
+func affected(env *Env, name string) []string {
+	names := []string{name}
+	seen := map[string]bool{name: true}
+	for i := 0; i < len(names); i++ {
+		for _, d := range dependents(env, names[i]) {
+			if !seen[d] {
+				seen[d] = true
+				names = append(names, d)
+			}
+		}
+	}
+	return names
+}
+
+// 変数の値がかわったときに呼ばれる関数を登録します。
+// 代入した変数と、それに依存している変数の値がかわると、変数の名前と
+// 代入する前の値、代入したあとの値で呼ばれます。関数を定義しなおしたり
+// 削除したりして、その関数を呼んでいる変数の値がかわったときも
+// 呼ばれます。未定義のときの値はnil、評価がエラーになるときの値は
+// ErrorValueです。
+//  godentaku.OnChange(env, func(name string, before, after godentaku.Ast) {
+//      fmt.Println(name, before, "->", after)
+//  })
+func OnChange(env *Env, f func(name string, before, after Ast)) {
+	root := rootEnv(env)
+	root.watchers = append(root.watchers, f)
+}
+
+// 変数nameを代入する前の、値がかわるかもしれない変数の値をおぼえて
+// おきます。代入したあとでかえした関数を呼ぶと、値がかわった変数を
+// OnChange()で登録した関数に知らせます。
+// 代入する前の値は、前に知らせたときの値をvaluesにおぼえておいて
+// 使います。式を2回評価しないですみますし、rand() を使う式も前に
+// 知らせた値とくらべられます。
+func watch(env *Env, name string) func() {
+	if env.Parent != nil || len(env.watchers) == 0 {
+		return func() {}
+	}
+	ensureMaps(env)
+	names := affected(env, name)
+	before := make([]Ast, len(names))
+	for i, n := range names {
+		v, found := env.values[n]
+		if !found {
+			v = tryValue(env, n)
+		}
+		before[i] = v
+	}
+	return func() {
+		for i, n := range names {
+			after := tryValue(env, n)
+			if after == nil {
+				env.values[n] = nil, false
+			} else {
+				env.values[n] = after
+			}
+			if sameValue(before[i], after) {
+				continue
+			}
+			for _, f := range env.watchers {
+				f(n, before[i], after)
+			}
+		}
+	}
+}
+
+// 変数を評価したときのエラーです。
+// x = 1 / y のあとで y = 0 とすると、xの値はエラーになります。
+// OnChange()で登録した関数には、xの値としてこれをわたします。
+type ErrorValue struct {
+	Err *Error
+}
+
+func (e ErrorValue) String() string {
+	return e.Err.String()
+}
+func (e ErrorValue) Eval(_ *Env) Ast {
+	return e
+}
+
+// 変数nameを評価した値です。未定義ならnil、エラーになるときは
+// ErrorValueです。
+func tryValue(env *Env, name string) (v Ast) {
+	if _, owner := lookup(env, name); owner == nil {
+		return nil
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			err, ok := x.(*Error)
+			if !ok {
+				panic(x)
+			}
+			v = ErrorValue{err}
+		}
+	}()
+	return Symbol(name).Eval(env)
+}
+
+// 2つの値がおなじかどうか。型がちがっても表示がおなじならおなじと
+// みなします。
+func sameValue(a, b Ast) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.String() == b.String()
+}
+
+// deps(x): 変数xの式で使っている変数のリスト
+//  x = y + z のとき deps(x) = [y, z]
+func depsFunc(args []Ast, env *Env) Ast {
+	name := varName("deps", args)
+	return symbolList(rootEnv(env).deps[name])
+}
+
+// dependents(x): 変数xを式で使っている変数のリスト
+//  x = y + z のとき dependents(y) = [x]
+func dependentsFunc(args []Ast, env *Env) Ast {
+	name := varName("dependents", args)
+	return symbolList(dependents(env, name))
+}
+
+// 変数を1つうけとる関数の引数から、評価せずに変数の名前をとりだします。
+func varName(name string, args []Ast) string {
+	checkArgs(name, args, 1, 1)
+	sym, ok := bare(args[0]).(Symbol)
+	if !ok {
+		panic(newError(TypeError, PosOf(args[0]),
+			"not variable", args[0].String()))
+	}
+	return string(sym)
+}
+
+// 名前のsliceをSymbolのListにします。
+func symbolList(names []string) List {
+	l := make(List, len(names))
+	for i, name := range names {
+		l[i] = Symbol(name)
+	}
+	return l
+}
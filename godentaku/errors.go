@@ -0,0 +1,131 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// エラーの種類です。
+// このように型をつけた定数をつくっておくと、数値をそのまま使うより
+// 間違いにくくなります。iotaはconstの中で0, 1, 2...と増えていきます。
+type ErrorKind int
+
+const (
+	SyntaxError     ErrorKind = iota // 入力が文法にあっていない
+	NameError                        // 知らない関数をよんだなど
+	TypeError                        // 演算できない値の組合せ
+	DivisionError                    // 0での割り算
+	ValueError                       // .printBaseなどの設定値がおかしい
+	InternalError                    // godentaku自身の不具合によるpanic
+	IncompleteError                  // 式の途中で入力が終わっている
+	OverflowError                    // Fixedの計算が型におさまらない
+	RecursionError                   // 関数の呼出が深すぎる
+	CycleError                       // 変数の参照が循環している
+)
+
+var errorKindNames = []string{
+	SyntaxError:     "syntax error",
+	NameError:       "name error",
+	TypeError:       "type error",
+	DivisionError:   "division error",
+	ValueError:      "value error",
+	InternalError:   "internal error",
+	IncompleteError: "incomplete input",
+	OverflowError:   "overflow error",
+	RecursionError:  "recursion error",
+	CycleError:      "cycle",
+}
+
+func (k ErrorKind) String() string {
+	if int(k) < len(errorKindNames) {
+		return errorKindNames[k]
+	}
+	return fmt.Sprintf("error(%d)", int(k))
+}
+
+// godentakuのエラーです。
+// String()メソッドをもっているのでos.Errorとして扱うことができます。
+type Error struct {
+	Kind ErrorKind
+	Pos  Pos // エラーの原因となった位置
+	Msg  string
+	Frag string // エラーの原因となった入力や式
+}
+
+func (e *Error) String() string {
+	if e.Frag == "" {
+		return fmt.Sprintf("%s: %s", e.Kind, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Kind, e.Msg, e.Frag)
+}
+
+// Error型へのポインタを作ります。
+// パッケージの中ではpanic(newError(...))としてエラーをなげます。
+// fragの前後の改行などはとりのぞいておきます。
+func newError(kind ErrorKind, pos Pos, msg string, frag string) *Error {
+	return &Error{Kind: kind, Pos: pos, Msg: msg,
+		Frag: strings.TrimSpace(frag)}
+}
+
+// panicされた値をrecover()でつかまえて*errにいれます。
+// recover()はdeferされた関数の中から直接よばないと効かないので
+// defer catch(&err) のように使います。
+func catch(err *os.Error) {
+	if x := recover(); x != nil {
+		if e, ok := x.(*Error); ok {
+			*err = e
+			return
+		}
+		// 範囲外アクセスなどのruntimeのpanicもエラーにします。
+		*err = newError(InternalError, Pos{}, fmt.Sprint(x), "")
+	}
+}
+
+// errが入力の途中で終わっていたためのエラーかどうか。
+// REPLなどでは次の行を読んでつなげてからもう一度Read()します。
+func IsIncomplete(err os.Error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Kind == IncompleteError
+}
+
+// Read()と同じですが、panicするかわりにエラーをかえします。
+func TryRead(b []byte) (ast Ast, nbuf []byte, err os.Error) {
+	defer catch(&err)
+	ast, nbuf = Read(b)
+	return
+}
+
+// ReadAll()と同じですが、panicするかわりにエラーをかえします。
+func TryReadAll(b []byte) (stmts []Ast, err os.Error) {
+	defer catch(&err)
+	stmts = ReadAll(b)
+	return
+}
+
+// Eval()と同じですが、panicするかわりにエラーをかえします。
+func TryEval(ast Ast, env *Env) (v Ast, err os.Error) {
+	defer catch(&err)
+	v = Eval(ast, env)
+	return
+}
+
+// EvalAll()と同じですが、panicするかわりにエラーをかえします。
+// エラーになったときは、それまでの文の結果をvsにかえします。
+func TryEvalAll(stmts []Ast, env *Env) (vs []Ast, err os.Error) {
+	defer catch(&err)
+	for _, stmt := range stmts {
+		vs = append(vs, Eval(stmt, env))
+	}
+	return
+}
+
+// Print()と同じですが、panicするかわりにエラーをかえします。
+func TryPrint(v Ast, env *Env) (s string, err os.Error) {
+	defer catch(&err)
+	s = Print(v, env)
+	return
+}
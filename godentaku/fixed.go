@@ -0,0 +1,250 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"big"
+	"fmt"
+	"strconv"
+)
+
+// 固定長の整数の型です。i8, u16, i32, u64 のように書きます。
+type IntType struct {
+	Bits   uint // 8, 16, 32, 64
+	Signed bool
+}
+
+func (t IntType) String() string {
+	if t.Signed {
+		return fmt.Sprintf("i%d", t.Bits)
+	}
+	return fmt.Sprintf("u%d", t.Bits)
+}
+
+// tであらわせる最小値と最大値をかえします。
+func (t IntType) limits() (min, max *big.Int) {
+	one := big.NewInt(1)
+	if !t.Signed {
+		max = new(big.Int).Lsh(one, t.Bits)
+		return big.NewInt(0), max.Sub(max, one)
+	}
+	max = new(big.Int).Lsh(one, t.Bits-1)
+	min = new(big.Int).Neg(max)
+	return min, max.Sub(max, one)
+}
+
+// 使える固定長の整数の型です。
+// 数値の後ろにつける型の名前と、変換する関数の名前になります。
+var intTypes = []IntType{
+	{8, true}, {16, true}, {32, true}, {64, true},
+	{8, false}, {16, false}, {32, false}, {64, false},
+}
+
+// 固定長の整数をAstインターフェイスをみたすFixed型として定義します。
+// 255u8 や -1i32 のように数値の後ろに型をつけるか、u8(x) のように
+// 変換して作ります。
+// ハードウェアとおなじように計算するので、結果が型におさまらないときは
+// .overflow の設定にしたがって、下位bitだけのこすか(wrap)、最大値や
+// 最小値にするか(saturate)、エラーにします(error)。
+//
+// Valueは2の補数の表現で、Type.Bitsより上のbitはいつも0です。
+// たとえば -1i8 のValueは0xffです。
+type Fixed struct {
+	Type  IntType
+	Value uint64
+}
+
+func (f Fixed) String() string {
+	return f.Int().String() + f.Type.String()
+}
+func (f Fixed) Eval(_ *Env) Ast {
+	return f
+}
+
+// fの値を*big.Intにします。符号付きなら最上位bitが符号です。
+func (f Fixed) Int() *big.Int {
+	if f.Type.Signed {
+		shift := 64 - f.Type.Bits
+		return big.NewInt(int64(f.Value<<shift) >> shift)
+	}
+	return new(big.Int).SetUint64(f.Value)
+}
+
+// buf の先頭の u8 や i32 のような型の名前の長さをかえします。
+// 型の名前がなければ0です。
+func fixedSuffix(buf []byte) int {
+	if c := peek(buf); c != 'i' && c != 'u' {
+		return 0
+	}
+	n := skipDigits(buf, 1, isDigit)
+	if _, ok := intTypeOf(string(buf[:n])); !ok {
+		return 0
+	}
+	// 1u8x のように後ろに文字がつづくときは型の名前ではありません。
+	if c := peek(buf[n:]); isAlpha(c) || isDigit(c) {
+		return 0
+	}
+	return n
+}
+
+// 名前から型をさがします。
+func intTypeOf(name string) (t IntType, ok bool) {
+	for _, c := range intTypes {
+		if c.String() == name {
+			return c, true
+		}
+	}
+	return IntType{}, false
+}
+
+// 数値のあとに型の名前をつけたリテラルを読みます。
+// 型におさまらない値は.overflowの設定によらずエラーです。
+// -128i8 は -(128i8) なので、i8(-128) と書いてください。
+func fixedLiteral(num Ast, suffix string, tok Token) Fixed {
+	t, _ := intTypeOf(suffix)
+	if !isInteger(num) {
+		panic(newError(SyntaxError, tok.Pos,
+			"non-integer constant for "+suffix, tok.Text))
+	}
+	x := toBig(num)
+	if min, max := t.limits(); x.Cmp(min) < 0 || x.Cmp(max) > 0 {
+		panic(newError(SyntaxError, tok.Pos,
+			"constant overflows "+suffix, tok.Text))
+	}
+	return Fixed{t, wrapBits(t, x)}
+}
+
+// xの下位t.Bits bitをとりだします。
+// big.IntのAndは負の数を2の補数としてあつかいます。
+func wrapBits(t IntType, x *big.Int) uint64 {
+	mask := new(big.Int).Lsh(big.NewInt(1), t.Bits)
+	mask.Sub(mask, big.NewInt(1))
+	return new(big.Int).And(x, mask).Uint64()
+}
+
+// .overflowの設定を読みます。
+//  wrap      下位bitだけのこします (default)
+//  saturate  最大値か最小値にします
+//  error     OverflowErrorにします
+func overflowMode(env *Env) string {
+	mode := envSymbolOr(env, ".overflow", "wrap")
+	switch mode {
+	case "wrap", "saturate", "error":
+		return mode
+	}
+	panic(badSetting(env, ".overflow"))
+}
+
+// xをtの型のFixedにします。
+// おさまらないときは.overflowの設定にしたがいます。posとfragは
+// エラーのときに使います。
+func toFixed(t IntType, x *big.Int, pos Pos, frag string, env *Env) Fixed {
+	mode := overflowMode(env)
+	if min, max := t.limits(); x.Cmp(min) < 0 || x.Cmp(max) > 0 {
+		switch mode {
+		case "saturate":
+			if x.Sign() < 0 {
+				x = min
+			} else {
+				x = max
+			}
+		case "error":
+			panic(newError(OverflowError, pos,
+				"overflows "+t.String(), frag))
+		}
+	}
+	return Fixed{t, wrapBits(t, x)}
+}
+
+// Fixedをふくむ計算をします。
+// NumやBigNumは相手のFixedの型にあわせます。
+// いったん正確な値をもとめてから、型におさめます。
+func fixedCalc(e BinOp, l, r Ast, env *Env) Ast {
+	t := fixedType(e, l, r)
+	a, b := toBig(l), toBig(r)
+	var z *big.Int
+	if e.Op == "/" {
+		if b.Sign() == 0 {
+			panic(newError(DivisionError, e.Pos,
+				"division by zero", e.String()))
+		}
+		// ハードウェアとおなじように0の方向に切り捨てます。
+		z = new(big.Int).Quo(a, b)
+	} else {
+		z = bigCalc(e, a, b)
+	}
+	return toFixed(t, z, e.Pos, e.String(), env)
+}
+
+// Fixedをふくむ計算の結果の型をかえします。
+// Fixedどうしは型がおなじでなければいけません。分数や小数とは
+// 計算できません。
+func fixedType(e BinOp, l, r Ast) IntType {
+	var t IntType
+	for _, v := range []Ast{l, r} {
+		if n, ok := v.(Fixed); ok {
+			if t.Bits != 0 && t != n.Type {
+				panic(newError(TypeError, e.Pos,
+					fmt.Sprintf("mismatched types %s and %s",
+						t, n.Type), e.String()))
+			}
+			t = n.Type
+		}
+	}
+	for _, v := range []Ast{l, r} {
+		if _, ok := v.(Fixed); !ok && !isInteger(v) {
+			panic(newError(TypeError, e.Pos,
+				"non-integer operand for "+t.String(), e.String()))
+		}
+	}
+	return t
+}
+
+// u8(x) などの型の変換の関数を作ります。
+// 小数は0の方向に切り捨ててから変換します。おさまらないときは
+// .overflowの設定にしたがいます。
+func castFunc(t IntType) func(Ast, *Env) Ast {
+	return func(arg Ast, env *Env) Ast {
+		v := arg.Eval(env)
+		checkNumber(t.String(), v)
+		if !isValue(v) {
+			return deferCall(t.String(), v)
+		}
+		var x *big.Int
+		switch n := roundNumber(v, "down").(type) {
+		case Num, BigNum, Fixed:
+			x = toBig(n)
+		case Float:
+			s := strconv.Ftoa64(float64(n), 'f', 0)
+			var ok bool
+			if x, ok = new(big.Int).SetString(s, 10); !ok {
+				panic(newError(ValueError, PosOf(arg),
+					"cannot convert to "+t.String(), v.String()))
+			}
+		default:
+			panic(newError(TypeError, PosOf(arg),
+				"cannot convert to "+t.String(), v.String()))
+		}
+		return toFixed(t, x, PosOf(arg), arg.String(), env)
+	}
+}
+
+// Fixedを.printBaseの基数で文字列にします。
+// 10進数以外では2の補数の表現を型の幅まで0でうめて表示します。
+//  -1i8  10進数 -1  2進数 0b11111111  8進数 0377  16進数 0xff
+func printFixed(f Fixed, env *Env) string {
+	bits := int(f.Type.Bits)
+	base := envValueOr(env, ".printBase", 10)
+	switch base {
+	case 2:
+		return fmt.Sprintf("0b%0*b", bits, f.Value)
+	case 8:
+		return fmt.Sprintf("0%0*o", (bits+2)/3, f.Value)
+	case 10:
+		return f.Int().String()
+	case 16:
+		return fmt.Sprintf("0x%0*x", bits/4, f.Value)
+	}
+	panic(badSetting(env, ".printBase"))
+}
@@ -0,0 +1,175 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"big"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// 浮動小数点数をAstインターフェイスをみたすFloat型として定義します。
+// IEEE-754の倍精度なので、0で割ると+Infや-Inf、0/0はNaNになります。
+type Float float64
+
+func (f Float) String() string {
+	// 'g'で精度を-1にすると、元の値にもどせる一番短い表現になります。
+	return strconv.Ftoa64(float64(f), 'g', -1)
+}
+func (f Float) Eval(_ *Env) Ast {
+	return f
+}
+
+// bの文字が16進数の数字かどうか。
+func isHexDigit(b byte) bool {
+	return isDigit(b) || ('a' <= b && b <= 'f') || ('A' <= b && b <= 'F')
+}
+
+// buf[i:]の先頭からdigitにあう文字がつづくところまでの位置をかえします。
+func skipDigits(buf []byte, i int, digit func(byte) bool) int {
+	for i < len(buf) && digit(buf[i]) {
+		i++
+	}
+	return i
+}
+
+// byte sliceをスキャンして数値をとりだします。
+// 後ろに i がついていればComplex型の虚数になります。
+//  3  0x1f  3.14  4i  2.5i
+func getNumber(buf []byte) (num Ast, nbuf []byte) {
+	num, nbuf = getReal(buf)
+	// 4if のように i の後に文字がつづくときは虚数ではありません。
+	if peek(nbuf) == 'i' {
+		if c := peek(nbuf[1:]); !isAlpha(c) && !isDigit(c) {
+			return Complex(complex(0, toFloat(num))), nbuf[1:]
+		}
+	}
+	return num, nbuf
+}
+
+// byte sliceをスキャンして実数をとりだします。
+// 小数点か指数がついていれば小数として、そうでなければgetNum()で整数と
+// して読みます。
+// 10進数の小数は入力どおりの値をおぼえておけるようにDecimal型に、
+// 16進数の小数はFloat型になります。
+//  3.14  .5  6.02e23  1e-3    10進数
+//  0x1.8p3  0x1p-2            16進数(指数はpのあとに2の何乗かを10進数で)
+func getReal(buf []byte) (num Ast, nbuf []byte) {
+	hex := len(buf) > 1 && buf[0] == '0' && (buf[1] == 'x' || buf[1] == 'X')
+	digit, exp := isDigit, byte('e')
+	i := 0
+	if hex {
+		digit, exp, i = isHexDigit, 'p', 2
+	}
+	mantissa := i
+	i = skipDigits(buf, i, digit)
+	isFloat := false
+	if i < len(buf) && buf[i] == '.' {
+		isFloat = true
+		i = skipDigits(buf, i+1, digit)
+	}
+	end := i
+	// 指数は e のあとに数字があるときだけです。
+	// 1.e のようにeの後に数字がなければ、eは次のSymbolになります。
+	if i < len(buf) && (buf[i] == exp || buf[i] == exp-'a'+'A') {
+		j := i + 1
+		if j < len(buf) && (buf[j] == '+' || buf[j] == '-') {
+			j++
+		}
+		if k := skipDigits(buf, j, isDigit); k > j {
+			isFloat = true
+			end = k
+		}
+	}
+	if !isFloat {
+		return getNum(buf)
+	}
+	if hex {
+		return Float(hexFloat(string(buf[mantissa:end]))), buf[end:]
+	}
+	return parseDecimal(string(buf[:end])), buf[end:]
+}
+
+// 16進数の浮動小数点数 1.8p3 (0xはとりのぞいたもの)をfloat64にします。
+func hexFloat(s string) float64 {
+	var f float64
+	exp := 0
+	dot := false
+	i := 0
+	for ; i < len(s) && s[i] != 'p' && s[i] != 'P'; i++ {
+		if s[i] == '.' {
+			dot = true
+			continue
+		}
+		// 小数点より後ろの桁は1桁ごとに2の-4乗になります。
+		f = f*16 + float64(digitVal(s[i]))
+		if dot {
+			exp -= 4
+		}
+	}
+	if i < len(s) {
+		e, _ := strconv.Atoi(s[i+1:])
+		exp += e
+	}
+	return math.Ldexp(f, exp)
+}
+
+// *big.Intをfloat64にします。
+func bigToFloat(x *big.Int) float64 {
+	// 10進数の文字列を経由すればいちばん近いfloat64になります。
+	f, _ := strconv.Atof64(x.String())
+	return f
+}
+
+// 数値をfloat64にします。
+func toFloat(v Ast) float64 {
+	switch n := v.(type) {
+	case Num:
+		return float64(n)
+	case BigNum:
+		return bigToFloat(n.Int)
+	case Rational:
+		return bigToFloat(n.Num()) / bigToFloat(n.Denom())
+	case Decimal:
+		// n.String()は指数が大きいと長い文字列になるので、
+		// "25e-2" のような指数の形にして変換します。
+		f, _ := strconv.Atof64(n.Unscaled.String() + "e" + strconv.Itoa(-n.Scale))
+		return f
+	case Float:
+		return float64(n)
+	case Fixed:
+		return bigToFloat(n.Int())
+	}
+	panic(newError(TypeError, PosOf(v), "not number", v.String()))
+}
+
+// float64で計算します。
+// IEEE-754のとおり、0で割ってもエラーにはしません。
+func floatCalc(e BinOp, a, b float64) float64 {
+	switch e.Op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	case "%":
+		return math.Fmod(a, b)
+	}
+	panic(newError(TypeError, e.Pos,
+		fmt.Sprintf("unsupported binOp:%s", e.Op), e.String()))
+}
+
+// Floatを.printPrecisionの有効桁数で文字列にします。
+// -1なら元の値にもどせる一番短い表現です。
+func printFloat(f Float, env *Env) string {
+	prec := envValueOr(env, ".printPrecision", -1)
+	if prec < -1 {
+		panic(badSetting(env, ".printPrecision"))
+	}
+	return strconv.Ftoa64(float64(f), 'g', prec)
+}
@@ -0,0 +1,171 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 関数定義をAstインターフェイスをみたすFuncDef型として定義します。
+//  area(w, h) = w * h
+// のように書くと、評価したときにenv.Defに登録されて area(2, 3) の
+// ように呼びだせるようになります。
+// 関数の中から自分自身を呼ぶこともできますが、呼出の深さは .maxDepth
+// までです。
+//  fact(n) = n <= 1 ? 1 : n * fact(n - 1)
+type FuncDef struct {
+	Name   Symbol
+	Params []Symbol
+	Body   Ast
+	Pos    Pos
+}
+
+func (d FuncDef) String() string {
+	params := make([]string, len(d.Params))
+	for i, p := range d.Params {
+		params[i] = string(p)
+	}
+	return fmt.Sprintf("%s(%s) = %s", d.Name, strings.Join(params, ", "), d.Body)
+}
+func (d FuncDef) Position() Pos {
+	return d.Pos
+}
+func (d FuncDef) Eval(env *Env) Ast {
+	// 関数を定義しなおすと、関数を呼んでいる式の値もかわります。
+	notify := watch(env, string(d.Name))
+	ensureMaps(env)
+	env.Def[string(d.Name)] = d
+	refreshDeps(env)
+	notify()
+	return d
+}
+
+// f(a, b) = ... の左辺からFuncDefを作ります。
+// 引数はおなじ名前のないSymbolでなければいけません。
+func newFuncDef(call FunCall, body Ast, pos Pos) FuncDef {
+	params := make([]Symbol, len(call.Args))
+	for i, arg := range call.Args {
+		sym, ok := bare(arg).(Symbol)
+		if !ok {
+			panic(newError(SyntaxError, PosOf(arg),
+				"parameter is not symbol", arg.String()))
+		}
+		for _, p := range params[:i] {
+			if p == sym {
+				panic(newError(SyntaxError, PosOf(arg),
+					"duplicate parameter", arg.String()))
+			}
+		}
+		params[i] = sym
+	}
+	return FuncDef{Name: call.Func, Params: params, Body: body, Pos: pos}
+}
+
+// 定義した関数dを呼びだします。
+func (d FuncDef) call(args []Ast, env *Env) Ast {
+	return callBody(string(d.Name), d.Params, d.Body, rootEnv(env), args, env)
+}
+
+// 無名関数をAstインターフェイスをみたすLambda型として定義します。
+//  x -> x * 2
+//  (x, y) -> x + y
+// のように書きます。評価すると、そのときの引数をおぼえたClosureに
+// なります。
+type Lambda struct {
+	Params []Symbol
+	Body   Ast
+	Pos    Pos
+}
+
+func (l Lambda) String() string {
+	if len(l.Params) == 1 {
+		return fmt.Sprintf("(%s -> %s)", l.Params[0], l.Body)
+	}
+	params := make([]string, len(l.Params))
+	for i, p := range l.Params {
+		params[i] = string(p)
+	}
+	return fmt.Sprintf("((%s) -> %s)", strings.Join(params, ", "), l.Body)
+}
+func (l Lambda) Position() Pos {
+	return l.Pos
+}
+func (l Lambda) Eval(env *Env) Ast {
+	return Closure{Lambda: l, Env: env}
+}
+
+// Lambdaを評価した値です。関数の値として変数にいれたり、map()などの
+// 関数にわたしたりできます。
+// 定義したときのEnvをおぼえているので、
+//  adder(n) = x -> x + n
+// の adder(3) は、呼びだしたあとも n = 3 を使えます。
+type Closure struct {
+	Lambda
+	Env *Env
+}
+
+func (c Closure) Eval(_ *Env) Ast {
+	return c
+}
+
+// Closureを呼びだします。
+func (c Closure) call(args []Ast, env *Env) Ast {
+	return callBody("lambda", c.Params, c.Body, c.Env, args, env)
+}
+
+// .maxDepthが設定されていないときの呼出の深さです。
+const defaultMaxDepth = 1000
+
+// .maxDepthに設定できる上限です。
+// 呼出が深くなるとGoのスタックも深くなっていき、スタックがあふれると
+// recover()できずにプログラムごと終了してしまうので、それより浅い
+// ところまでしか設定できないようにしておきます。
+const maxMaxDepth = 10000
+
+// 関数の本体を呼びだします。
+// 引数は呼出元のenvで評価してから、scopeの子のEnvの変数にして本体を
+// 評価します。scopeは関数を定義したEnvです。
+func callBody(name string, params []Symbol, body Ast, scope *Env, args []Ast, env *Env) Ast {
+	checkArgs(name, args, len(params), len(params))
+	max := envValueOr(env, ".maxDepth", defaultMaxDepth)
+	if max < 0 || max > maxMaxDepth {
+		panic(badSetting(env, ".maxDepth"))
+	}
+	if env.depth >= max {
+		panic(newError(RecursionError, Pos{},
+			fmt.Sprintf("too deep recursion (.maxDepth = %d)", max),
+			name))
+	}
+	frame := NewChildEnv(scope)
+	frame.depth = env.depth + 1
+	for i, p := range params {
+		frame.Var[string(p)] = Value{args[i].Eval(env)}
+	}
+	return body.Eval(frame)
+}
+
+// fを関数として引数argsで呼びだします。
+// fはClosureか、関数の名前のSymbolです。
+func callValue(f Ast, args []Ast, env *Env) Ast {
+	switch fn := f.(type) {
+	case Closure:
+		return fn.call(args, env)
+	case Symbol:
+		return FunCall{Func: fn, Args: args, Pos: PosOf(f)}.Eval(env)
+	}
+	panic(newError(TypeError, PosOf(f), "not function", f.String()))
+}
+
+// defs(): 定義されている関数の一覧です。
+func defsFunc(args []Ast, env *Env) Ast {
+	checkArgs("defs", args, 0, 0)
+	var defs []string
+	for _, d := range env.Def {
+		defs = append(defs, d.String())
+	}
+	sort.SortStrings(defs)
+	return String(strings.Join(defs, "\n"))
+}
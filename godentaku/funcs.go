@@ -0,0 +1,128 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"fmt"
+	"rand"
+)
+
+// 引数の数がmin以上max以下か調べます。maxが-1なら上限はありません。
+func checkArgs(name string, args []Ast, min, max int) {
+	if len(args) >= min && (max < 0 || len(args) <= max) {
+		return
+	}
+	var want string
+	switch {
+	case min == max:
+		want = fmt.Sprintf("%d", min)
+	case max < 0:
+		want = fmt.Sprintf("at least %d", min)
+	default:
+		want = fmt.Sprintf("%d to %d", min, max)
+	}
+	// 位置はFunCall.Eval()がつけてくれます。
+	panic(newError(TypeError, Pos{},
+		fmt.Sprintf("%s takes %s argument(s)", name, want),
+		fmt.Sprintf("%d given", len(args))))
+}
+
+// 引数を評価して、すべて数値ならfを、未定義のSymbolをふくむときは
+// 関数呼出のままかえす関数を作ります。mathFunc()の引数がいくつでも
+// よい版です。
+// max(true, 2) や round("a") のように数値でない値があればエラーです。
+func mathFuncN(name string, min, max int, f func([]Ast, *Env) Ast) func([]Ast, *Env) Ast {
+	return func(args []Ast, env *Env) Ast {
+		checkArgs(name, args, min, max)
+		vals := make([]Ast, len(args))
+		value := true
+		for i, arg := range args {
+			vals[i] = arg.Eval(env)
+			checkNumber(name, vals[i])
+			value = value && isValue(vals[i])
+		}
+		if !value {
+			return deferCall(name, vals...)
+		}
+		return f(vals, env)
+	}
+}
+
+// vが数値でない値なら、関数nameの引数の型のエラーにします。
+// 未定義のSymbolをふくむときのように、まだ値でなければ数値になる
+// かもしれないのでエラーにしません。
+// 位置はFunCall.Eval()がつけてくれます。
+func checkNumber(name string, v Ast) {
+	if isValue(v) && !isNumber(v) {
+		panic(newError(TypeError, Pos{}, name+": not number", v.String()))
+	}
+}
+
+// a < b かどうか。
+func less(a, b Ast, env *Env) bool {
+	return bool(compare(BinOp{Op: "<", Left: a, Right: b}, a, b, env).(Bool))
+}
+
+// mod(a, b): ユークリッドの剰余
+func modFunc(args []Ast, env *Env) Ast {
+	e := BinOp{Op: "%", Left: args[0], Right: args[1]}
+	return euclidMod(e, args[0], args[1], env)
+}
+
+// powmod(b, e, m): b**e を m で割ったあまり
+func powmodFunc(args []Ast, _ *Env) Ast {
+	return powMod(args[0], args[1], args[2], Pos{},
+		deferCall("powmod", args...).String())
+}
+
+// max(a, b, ...): 一番大きい値。型はそのままです。
+func maxFunc(args []Ast, env *Env) Ast {
+	m := args[0]
+	for _, v := range args[1:] {
+		if less(m, v, env) {
+			m = v
+		}
+	}
+	return m
+}
+
+// min(a, b, ...): 一番小さい値。型はそのままです。
+func minFunc(args []Ast, env *Env) Ast {
+	m := args[0]
+	for _, v := range args[1:] {
+		if less(v, m, env) {
+			m = v
+		}
+	}
+	return m
+}
+
+// clamp(x, lo, hi): xをlo以上hi以下にします。
+func clampFunc(args []Ast, env *Env) Ast {
+	x, lo, hi := args[0], args[1], args[2]
+	switch {
+	case less(hi, lo, env):
+		panic(newError(ValueError, Pos{}, "clamp: lo > hi",
+			deferCall("clamp", args...).String()))
+	case less(x, lo, env):
+		return lo
+	case less(hi, x, env):
+		return hi
+	}
+	return x
+}
+
+// rand(): 0以上1未満のFloatの乱数
+// rand(n): 0以上n未満の整数の乱数
+func randFunc(args []Ast, _ *Env) Ast {
+	if len(args) == 0 {
+		return Float(rand.Float64())
+	}
+	n, ok := args[0].(Num)
+	if !ok || n <= 0 {
+		panic(newError(ValueError, Pos{}, "rand: bad range",
+			args[0].String()))
+	}
+	return Num(rand.Int63n(int64(n)))
+}
@@ -24,7 +24,11 @@ package godentaku
 // インポートによる副作用が必要な場合は
 //  import _ "some/package"
 // のように _ としてインポートします。
-import "fmt"
+import (
+	"big"
+	"fmt"
+	"strings"
+)
 
 // 型定義です。
 // string型を返すString()というメソッドとEnv型へのポインタをうけとってAst型を
@@ -45,12 +49,29 @@ type Ast interface {
 // string型をキーにして、Ast型とEnv型へのポインタをうけとってAst型を返す関数を
 // 要素としてもつmap型のFuncというフィールドをもつ構造体を Env型として定義
 // しています。
+// FuncNは引数をいくつでもうけとる関数で、引数はAst型のsliceになります。
+// Defは f(x) = x * 2 のように入力で定義した関数です。
+// Parentは親のスコープで、Varに見つからない変数は親のほうへさがします。
+// 小文字ではじまるフィールドはパッケージの外からは見えません。
+// depthは関数の呼出の深さ、activeは評価している途中の変数を評価を
+// はじめた順にならべたもの、depsは変数の依存、callsは変数の式で呼んで
+// いる関数、valuesはOnChange()で最後に知らせた変数の値、watchersは
+// OnChange()で登録した関数です。
 // mapのキーにはstruct, array, slice型は使えません。
 // 大文字ではじまっているので、この型およびこの型の中のフィールドは
 // パッケージの外で利用できます。
 type Env struct {
-	Var  map[string]Ast
-	Func map[string]func(Ast, *Env) Ast
+	Var      map[string]Ast
+	Func     map[string]func(Ast, *Env) Ast
+	FuncN    map[string]func([]Ast, *Env) Ast
+	Def      map[string]FuncDef
+	Parent   *Env
+	depth    int
+	active   []varRef
+	deps     map[string][]string
+	calls    map[string][]string
+	values   map[string]Ast
+	watchers []func(name string, before, after Ast)
 }
 
 // NewEnv()という関数定義です。
@@ -68,12 +89,64 @@ func NewEnv() *Env {
 	// makeで初期化するのはmapの他にslice, chanがあります。
 	env.Var = make(map[string]Ast)
 	env.Func = make(map[string]func(Ast, *Env) Ast)
-	// 以上の3行は次のように書くこともできます。
+	env.FuncN = make(map[string]func([]Ast, *Env) Ast)
+	env.Def = make(map[string]FuncDef)
+	env.deps = make(map[string][]string)
+	env.calls = make(map[string][]string)
+	// 以上の7行は次のように書くこともできます。
 	//  env := &Env{Var: make(map[string]Ast),
-	//              Func: make(map[string]func(Ast,*Env)Ast)}
+	//              Func: make(map[string]func(Ast,*Env)Ast),
+	//              FuncN: make(map[string]func([]Ast,*Env)Ast),
+	//              Def: make(map[string]FuncDef),
+	//              deps: make(map[string][]string),
+	//              calls: make(map[string][]string)}
 
 	// Set関数の呼出です。定義が後にあっても大丈夫です。
 	Set(env, ".printBase", 10)
+	SetExpr(env, ".printRational", Symbol("fraction"))
+	Set(env, ".printDigits", 10)
+	Set(env, ".printPrecision", -1)
+	SetExpr(env, ".decimal", Bool(false))
+	Set(env, ".decimalScale", 20)
+	SetExpr(env, ".rounding", Symbol("halfeven"))
+	SetExpr(env, ".printComplex", Symbol("rect"))
+	SetExpr(env, ".overflow", Symbol("wrap"))
+	Set(env, ".maxDepth", defaultMaxDepth)
+
+	// 組込みの関数を登録します。
+	SetFunc(env, "num", numFunc)
+	SetFunc(env, "den", denFunc)
+	SetFunc(env, "re", mathFunc("re", reFunc))
+	SetFunc(env, "im", mathFunc("im", imFunc))
+	SetFunc(env, "abs", mathFunc("abs", absFunc))
+	SetFunc(env, "arg", mathFunc("arg", argFunc))
+	SetFunc(env, "conj", mathFunc("conj", conjFunc))
+	for _, t := range intTypes {
+		SetFunc(env, t.String(), castFunc(t))
+	}
+	SetFuncN(env, "round", roundFunc("round", ""))
+	SetFuncN(env, "floor", roundFunc("floor", "floor"))
+	SetFuncN(env, "ceil", roundFunc("ceil", "ceiling"))
+	SetFuncN(env, "truncate", roundFunc("truncate", "down"))
+	SetFuncN(env, "mod", mathFuncN("mod", 2, 2, modFunc))
+	SetFuncN(env, "powmod", mathFuncN("powmod", 3, 3, powmodFunc))
+	SetFuncN(env, "max", mathFuncN("max", 1, -1, maxFunc))
+	SetFuncN(env, "min", mathFuncN("min", 1, -1, minFunc))
+	SetFuncN(env, "clamp", mathFuncN("clamp", 3, 3, clampFunc))
+	SetFuncN(env, "rand", mathFuncN("rand", 0, 1, randFunc))
+	SetFuncN(env, "defs", defsFunc)
+	SetFuncN(env, "map", mapFunc)
+	SetFuncN(env, "filter", filterFunc)
+	SetFuncN(env, "reduce", reduceFunc)
+	SetFuncN(env, "apply", applyFunc)
+	SetFuncN(env, "varkind", varkindFunc)
+	SetFuncN(env, "deps", depsFunc)
+	SetFuncN(env, "dependents", dependentsFunc)
+	SetFuncN(env, "len", lenFunc)
+	SetFuncN(env, "substr", substrFunc)
+	SetFuncN(env, "upper", upperFunc)
+	SetFuncN(env, "lower", lowerFunc)
+	SetFuncN(env, "format", formatFunc)
 	return env
 }
 
@@ -99,6 +172,35 @@ func SetFunc(env *Env, funcname string, funcCode func(Ast, *Env) Ast) {
 	env.Func[funcname] = funcCode
 }
 
+// SetFuncN()はSetFunc()の引数がいくつでもよい版です。
+// max(a, b) や rand() のような関数を登録します。
+// 引数の数を調べるのはfuncCodeの仕事です。
+func SetFuncN(env *Env, funcname string, funcCode func([]Ast, *Env) Ast) {
+	ensureMaps(env)
+	env.FuncN[funcname] = funcCode
+}
+
+// NewEnv()を使わずに &Env{Var: ..., Func: ...} のように作ったEnvでは、
+// FuncN, Def, deps, calls, valuesはnilです。nilのmapに書きこむとpanicするので、
+// 書きこむ前にこれで作っておきます。
+func ensureMaps(env *Env) {
+	if env.FuncN == nil {
+		env.FuncN = make(map[string]func([]Ast, *Env) Ast)
+	}
+	if env.Def == nil {
+		env.Def = make(map[string]FuncDef)
+	}
+	if env.deps == nil {
+		env.deps = make(map[string][]string)
+	}
+	if env.calls == nil {
+		env.calls = make(map[string][]string)
+	}
+	if env.values == nil {
+		env.values = make(map[string]Ast)
+	}
+}
+
 // envValue()という関数定義です。
 // Env型へのポインタとstring型をうけとって、int型とbool型をかえします。
 // このように多値をかえすことは普通におこなえます。
@@ -109,13 +211,17 @@ func envValue(env *Env, key string) (n int, ok bool) {
 	// 書きます。found がtrueなら要素あり、falseならなしです。
 	// v := env.Var[key]としてkeyに対する値がない時は要素型の初期値
 	// がかえってきます。
-	if v, found := env.Var[key]; found {
-		// v は Varの型定義によりAst型の変数です。
+	// 設定はふつう一番親のEnvにあるので、親のほうまでさがします。
+	if _, owner := lookup(env, key); owner != nil {
+		// 評価した値はAst型です。
 		// num, ok := v.(Num)とよびだすことで、Num型へ型変換をためす
 		// ことができます。型変換できればnumはNum型になったときの値、
 		// okがtrueになりませす。型変換できなければnumはNum型の初期値、
 		// okがfalseです。
-		if num, ok := v.(Num); ok {
+		// 設定には -1 のような式も書けるので、評価してから調べます。
+		// Symbolとして評価すると、設定の式が自分自身を使っていれば
+		// 循環のエラーになります。
+		if num, ok := Symbol(key).Eval(env).(Num); ok {
 			// numは下記のようにもともとint型なのでint型に変換
 			// できます。
 			return int(num), true
@@ -124,9 +230,68 @@ func envValue(env *Env, key string) (n int, ok bool) {
 	return 0, false
 }
 
+// envSymbol()はenvValue()のSymbol版です。
+// .printRationalのように、値を名前でえらぶ設定を読むのに使います。
+func envSymbol(env *Env, key string) (s string, ok bool) {
+	if v, owner := lookup(env, key); owner != nil {
+		switch s := bare(v).(type) {
+		case Symbol:
+			return string(s), true
+		case String:
+			// .rounding = "half_even" のように文字列でも設定できます。
+			return string(s), true
+		}
+	}
+	return "", false
+}
+
+// envValue()とおなじですが、keyが設定されていないときはdefをかえします。
+// NewEnv()を使わずに作ったEnvや、.printPrecision = undef のあとでも
+// 表示できるようにします。設定されていても数値でなければエラーです。
+func envValueOr(env *Env, key string, def int) int {
+	if _, owner := lookup(env, key); owner == nil {
+		return def
+	}
+	n, ok := envValue(env, key)
+	if !ok {
+		panic(badSetting(env, key))
+	}
+	return n
+}
+
+// envSymbolOr()はenvValueOr()のSymbol版です。
+func envSymbolOr(env *Env, key string, def string) string {
+	if _, owner := lookup(env, key); owner == nil {
+		return def
+	}
+	s, ok := envSymbol(env, key)
+	if !ok {
+		panic(badSetting(env, key))
+	}
+	return s
+}
+
+// keyの設定値がおかしいというエラーを作ります。
+func badSetting(env *Env, key string) *Error {
+	// 設定されていないときはnilなので、v.String()ではなくfmt.Sprint()で
+	// 文字列にします。
+	v, _ := lookup(env, key)
+	return newError(ValueError, Pos{}, "bad "+key, fmt.Sprint(v))
+}
+
+// keyの設定がtrueかどうか。.decimal = 1 のように0以外の数値でも
+// trueとみなします。
+// 0.5 のような小数を評価するときも.decimalを調べるので、
+// .decimal = 0.5 > 1 のような設定は、Symbolとして評価して循環の
+// エラーにします。そのまま評価するといつまでも終わりません。
 func Defined(env *Env, key string) bool {
-	if n, found := envValue(env, key); found {
-		return n != 0
+	if _, owner := lookup(env, key); owner != nil {
+		switch b := Symbol(key).Eval(env).(type) {
+		case Bool:
+			return bool(b)
+		case Num:
+			return b != 0
+		}
 	}
 	return false
 }
@@ -176,119 +341,371 @@ func (s Symbol) Eval(env *Env) Ast {
 	// Symbolを評価した結果をかえします。
 	name := string(s)
 	// もしSymbol名がVarに登録されていたらその値に展開します。
-	if v, found := env.Var[name]; found {
-		// 再帰的に評価されるのをふせぐために0にしています。
-		// もしこれがないと a = a + 1 のような式がどうなるか
-		// 考えてみましょう
-		env.Var[name] = Num(0)
-		// Symbolに代入されていた式を評価します。
-		r := v.Eval(env)
-		// 元に戻します。
-		env.Var[name] = v
-		return r
-	}
-	// もしVarになければそのままかえします。
-	return s
+	// なければ親のEnvのVarをさがします。
+	v, owner := lookup(env, name)
+	if owner == nil {
+		// もしどこにもなければそのままかえします。
+		return s
+	}
+	// 関数の引数のような評価ずみの値はそのままかえします。
+	if val, ok := v.(Value); ok {
+		return val.Ast
+	}
+	// 評価している途中の変数をもう一度評価しようとしたら、
+	// a = b + 1, b = a のように参照が循環しているのでエラーにします。
+	// もしこれがないと a = a + 1 のような式がどうなるか
+	// 考えてみましょう
+	// 評価している途中の変数は一番親のEnvにおぼえておくので、
+	// 変数そのものは書きかえません。
+	root := rootEnv(env)
+	ref := varRef{owner, name}
+	for i, r := range root.active {
+		if r == ref {
+			panic(cycleError(root.active[i:], ref))
+		}
+	}
+	root.active = append(root.active, ref)
+	// deferで登録した関数は、panicしたときも呼ばれるので、かならず
+	// 元に戻せます。
+	defer func() {
+		root.active = root.active[:len(root.active)-1]
+	}()
+	// Symbolに代入されていた式を、変数が定義されたEnvで評価します。
+	// 関数やletの中のおなじ名前の変数は式からは見えません。
+	return v.Eval(owner)
 }
 
 // 単項式をAstインターフェイスをみたすUnaryOp型として定義します。
 type UnaryOp struct {
-	Op   byte
+	Op   string
 	Expr Ast
+	Pos  Pos
 }
 
 func (e UnaryOp) String() string {
-	return fmt.Sprintf("%c%s", e.Op, e.Expr)
+	return fmt.Sprintf("%s%s", e.Op, e.Expr)
+}
+func (e UnaryOp) Position() Pos {
+	return e.Pos
 }
 func (e UnaryOp) Eval(env *Env) Ast {
-	if e.Op != '-' {
-		// もし単項演算子が '-' じゃなかったpanicします。
-		// 処理をうちきって呼出元にもどっていきます。
-		// 途中 recoverされれば、ここで渡した値がとりだせます。
-		// recoverされなければ、プログラムは異常終了します。
-		panic(fmt.Sprintf("unsupported uniOp:%c", e.Op))
-	}
 	// UnaryOpのExprフィールドの内容を Evalします。
 	v := e.Expr.Eval(env)
-	// もし評価した結果が Num型だったら、マイナスにした値にしてかえします。
-	if n, ok := v.(Num); ok && e.Op == '-' {
-		return Num(-int(n))
+	if b, ok := v.(Bool); ok {
+		if e.Op != "!" {
+			panic(newError(TypeError, e.Pos, "not number", e.String()))
+		}
+		return !b
 	}
-	return v
+	// 評価した結果が値でなければ、評価した結果にしたUnaryOpを
+	// かえします。
+	if !isValue(v) {
+		return UnaryOp{Op: e.Op, Expr: v, Pos: e.Pos}
+	}
+	if e.Op == "!" {
+		panic(newError(TypeError, e.Pos, "not boolean", e.String()))
+	}
+	// "abc" や [1, 2] は - や ~ で計算できません。
+	if !isNumber(v) {
+		panic(newError(TypeError, e.Pos, "not number", e.String()))
+	}
+	switch e.Op {
+	case "-":
+		return negate(e, v, env)
+	case "~":
+		return complement(e, v)
+	}
+	// もし知らない単項演算子だったらpanicします。
+	// 処理をうちきって呼出元にもどっていきます。
+	// 途中 recoverされれば、ここで渡した値がとりだせます。
+	// recoverされなければ、プログラムは異常終了します。
+	panic(newError(TypeError, e.Pos,
+		fmt.Sprintf("unsupported uniOp:%s", e.Op), e.String()))
 }
 
 // 二項式をAstインターフェイスをみたすBinOp型として定義します。
 type BinOp struct {
-	Op    byte
+	Op    string
 	Left  Ast
 	Right Ast
+	Pos   Pos
 }
 
 func (e BinOp) String() string {
-	return fmt.Sprintf("(%s %c %s)", e.Left, e.Op, e.Right)
+	return fmt.Sprintf("(%s %s %s)", e.Left, e.Op, e.Right)
+}
+func (e BinOp) Position() Pos {
+	return e.Pos
 }
 func (e BinOp) Eval(env *Env) Ast {
+	// && と || は右辺を評価しないことがあるので別にあつかいます。
+	if e.Op == "&&" || e.Op == "||" {
+		return logicCalc(e, env)
+	}
 	l := e.Left.Eval(env)
 	r := e.Right.Eval(env)
 
-	lnum, lok := l.(Num)
-	rnum, rok := r.(Num)
-	// 左辺値、右辺値 評価して両方Num型だったら計算した結果にして
+	// 左辺値、右辺値 評価して両方数値だったら計算した結果にして
 	// かえします。
-	if lok && rok {
-		switch e.Op {
-		case '+':
-			return Num(int(lnum) + int(rnum))
-		case '-':
-			return Num(int(lnum) - int(rnum))
-		case '*':
-			return Num(int(lnum) * int(rnum))
-		case '/':
-			return Num(int(lnum) / int(rnum))
-		}
-		panic(fmt.Sprintf("unsupported binOp:%c", e.Op))
+	// NumとBigNumのように型がちがう場合はcalc()がそろえてくれます。
+	if isNumber(l) && isNumber(r) {
+		return calc(e, l, r, env)
+	}
+	// 数値でない値がまじっていればBoolの計算です。
+	// [1, 2] + 1 のようにBool以外の値はエラーになります。
+	if isValue(l) && isValue(r) {
+		if _, ok := l.(String); ok {
+			return stringCalc(e, l, r)
+		}
+		if _, ok := r.(String); ok {
+			return stringCalc(e, l, r)
+		}
+		return boolCalc(e, l, r)
 	}
 	// 左辺値、右辺値を評価した結果にしたBinOpをつくってかえします。
-	return BinOp{Op: e.Op, Left: l, Right: r}
+	return BinOp{Op: e.Op, Left: l, Right: r, Pos: e.Pos}
 }
 
 // 代入式をAstインターフェイスをみたすBinOp型として定義します。
+// x = y + 1 は式のまま代入するので、あとでyをかえるとxもかわります。
+// x := y + 1 はEagerがtrueになり、評価した値を代入します。
+// x += 1 のような代入はOpに"+"のような演算子がはいります。
 type AssignOp struct {
-	Var  Symbol
-	Expr Ast
+	Var   Symbol
+	Expr  Ast
+	Eager bool
+	Op    string
+	Pos   Pos
 }
 
 func (a AssignOp) String() string {
+	if a.Op != "" {
+		return fmt.Sprintf("%s %s= %s", a.Var, a.Op, a.Expr)
+	}
+	if a.Eager {
+		return fmt.Sprintf("%s := %s", a.Var, a.Expr)
+	}
 	return fmt.Sprintf("%s = %s", a.Var, a.Expr)
 }
+func (a AssignOp) Position() Pos {
+	return a.Pos
+}
 func (a AssignOp) Eval(env *Env) Ast {
-	v := a.Expr.Eval(env)
+	// 値がかわった変数を知らせるために、代入する前の値をおぼえて
+	// おきます。
+	notify := watch(env, string(a.Var))
+	v := a.assign(env)
+	notify()
+	return v
+}
+
+// 変数に代入して、依存をおぼえなおします。
+func (a AssignOp) assign(env *Env) Ast {
+	name := string(a.Var)
+	// x += e は今のxを使って計算します。
+	// xが値なら x := x + e、式なら式のまま x = (xの式) + e になります。
+	// x = y + 1 のあとの x += 1 は x = (y + 1) + 1 なので、yをかえると
+	// xもかわります。
+	// x += x のようにeでもxを使うときは、let x = (xの式) in x + x に
+	// します。
+	// xの式がほかの変数も関数も使っていなければ、式はもう評価した値に
+	// しておきます。x = 1 のあとで x += 1 をくりかえしても、式が長く
+	// ならずに x = 2 + 1 のようになります。
+	// x = g(1) のあとの x += 1 は、gを定義しなおすとかわるので
+	// x = g(1) + 1 のままです。
+	if a.Op != "" {
+		old, found := env.Var[name]
+		if !found {
+			panic(newError(NameError, a.Pos, "undefined variable", name))
+		}
+		var e Ast = BinOp{Op: a.Op, Left: a.Var, Right: a.Expr, Pos: a.Pos}
+		_, eager := old.(Value)
+		if !eager && isConstant(env, old) {
+			old = Atom{Value: old.Eval(env), Pos: PosOf(old)}
+		}
+		if !eager {
+			let := LetExpr{Names: []Symbol{a.Var}, Exprs: []Ast{old},
+				Body: e, Pos: a.Pos}
+			e = BinOp{Op: a.Op, Left: old, Right: a.Expr, Pos: a.Pos}
+			for _, v := range freeVars(env, a.Expr) {
+				if v == name {
+					e = let
+				}
+			}
+		}
+		a = AssignOp{Var: a.Var, Expr: e, Eager: eager, Pos: a.Pos}
+	}
 	// もし"undef"という式を代入する場合は、VarからSymbolの情報を削除します
-	if s, ok := a.Expr.(Symbol); ok && string(s) == "undef" {
+	// おなじ名前の関数の定義も削除します。
+	// a.ExprはパーザがつけたAtomでつつまれているのでbare()でとりだします。
+	if s, ok := bare(a.Expr).(Symbol); ok && string(s) == "undef" {
+		v := a.Expr.Eval(env)
 		// , falseをわたすことでmapから消すことができます。
-		env.Var[string(a.Var)] = a.Expr, false
-	} else {
-		env.Var[string(a.Var)] = a.Expr
+		env.Var[name] = a.Expr, false
+		ensureMaps(env)
+		env.Def[name] = FuncDef{}, false
+		setDeps(env, name, nil)
+		refreshDeps(env)
+		return v
+	}
+	// := なら今の値を評価ずみの値として代入します。
+	// 右辺のxは代入する前のxなので x := x + 1 もできます。
+	if a.Eager {
+		v := a.Expr.Eval(env)
+		env.Var[name] = Value{v}
+		setDeps(env, name, nil)
+		return v
 	}
+	// 代入してから評価して、式が自分自身を参照していないか
+	// たしかめます。エラーになったら代入する前に戻します。
+	old, found := env.Var[name]
+	env.Var[name] = a.Expr
+	defer func() {
+		if x := recover(); x != nil {
+			if found {
+				env.Var[name] = old
+			} else {
+				env.Var[name] = a.Expr, false
+			}
+			if err, ok := x.(*Error); ok && !err.Pos.IsValid() {
+				err.Pos = a.Pos
+			}
+			panic(x)
+		}
+	}()
+	v := a.Expr.Eval(env)
+	setDeps(env, name, a.Expr)
 	return v
 }
 
 // 関数呼出をAstインターフェイスをみたすBinOp型として定義します。
 type FunCall struct {
 	Func Symbol
-	Expr Ast
+	Args []Ast
+	Pos  Pos
 }
 
 func (f FunCall) String() string {
-	return fmt.Sprintf("%s(%s)", f.Func, f.Expr)
+	args := make([]string, len(f.Args))
+	for i, arg := range f.Args {
+		args[i] = arg.String()
+	}
+	return fmt.Sprintf("%s(%s)", f.Func, strings.Join(args, ", "))
+}
+func (f FunCall) Position() Pos {
+	return f.Pos
 }
 func (f FunCall) Eval(env *Env) Ast {
-	// f.FuncというSymbolがenv.Funcにあったらその関数を呼出ます。
+	// 関数の中で位置のないエラーがおきたら、この呼出の位置にします。
+	// deferで登録した関数はpanicしたときにも呼ばれます。
+	defer func() {
+		if x := recover(); x != nil {
+			if err, ok := x.(*Error); ok && !err.Pos.IsValid() {
+				err.Pos = f.Pos
+			}
+			panic(x)
+		}
+	}()
+	name := string(f.Func)
+	// 入力で定義した関数は組込みの関数より優先します。
+	if d, ok := env.Def[name]; ok {
+		return d.call(f.Args, env)
+	}
+	// 変数の値が f = x -> x * 2 のようなClosureなら、それを呼出ます。
+	if c, ok := varClosure(env, name); ok {
+		return c.call(f.Args, env)
+	}
+	// f.FuncというSymbolがenv.FuncNにあったらその関数を呼出ます。
+	if fun, ok := env.FuncN[name]; ok {
+		return fun(f.Args, env)
+	}
+	// env.Funcにあったら引数を1つわたして呼出ます。
 	// funはenv.Funcの定義によりfunc (Ast, *Env) Astです。
-	if fun, ok := env.Func[string(f.Func)]; ok {
-		return fun(f.Expr, env)
+	if fun, ok := env.Func[name]; ok {
+		checkArgs(name, f.Args, 1, 1)
+		return fun(f.Args[0], env)
+	}
+	panic(newError(NameError, f.Pos, "no such function", name))
+}
+
+// 変数nameの値がClosureならそれをかえします。
+// 組込みの関数とおなじ名前の変数は、入っているのがLambdaかClosureの
+// ときだけ評価します。min = min(a, b) のminを評価すると、式の中の
+// min(a, b) がまた変数minを評価してしまうからです。
+func varClosure(env *Env, name string) (c Closure, ok bool) {
+	v, owner := lookup(env, name)
+	if owner == nil {
+		return c, false
+	}
+	_, isFunc := env.Func[name]
+	_, isFuncN := env.FuncN[name]
+	if isFunc || isFuncN {
+		switch v := bare(v).(type) {
+		case Lambda:
+		case Value:
+			if _, ok := v.Ast.(Closure); !ok {
+				return c, false
+			}
+		default:
+			return c, false
+		}
+	}
+	c, ok = Symbol(name).Eval(env).(Closure)
+	return c, ok
+}
+
+// 条件式をAstインターフェイスをみたすIfExpr型として定義します。
+//  if cond then a else b
+//  cond ? a : b
+// のどちらで書いてもおなじです。
+type IfExpr struct {
+	Cond Ast
+	Then Ast
+	Else Ast
+	Pos  Pos
+}
+
+func (e IfExpr) String() string {
+	return fmt.Sprintf("(%s ? %s : %s)", e.Cond, e.Then, e.Else)
+}
+func (e IfExpr) Position() Pos {
+	return e.Pos
+}
+func (e IfExpr) Eval(env *Env) Ast {
+	c := e.Cond.Eval(env)
+	// 評価するのはえらんだほうの式だけです。
+	// x != 0 ? 1/x : 0 のように、もう一方がエラーになる式でも
+	// かまいません。
+	if b, ok := c.(Bool); ok {
+		if b {
+			return e.Then.Eval(env)
+		}
+		return e.Else.Eval(env)
 	}
-	panic(fmt.Sprintf("no such function: %s", f.Func))
+	if isValue(c) {
+		panic(newError(TypeError, PosOf(e.Cond),
+			"non-boolean condition", c.String()))
+	}
+	// 条件が未定義のSymbolをふくむときは、BinOpとおなじように
+	// 評価した条件にしたIfExprをかえします。どちらになるかわからない
+	// ので、aとbは評価しません。
+	return IfExpr{Cond: c, Then: e.Then, Else: e.Else, Pos: e.Pos}
+}
+
+// 空行をAstインターフェイスをみたすEmpty型として定義します。
+// 評価してもなにもおきません。
+type Empty struct {
+	Pos Pos
+}
+
+func (e Empty) String() string {
+	return ""
+}
+func (e Empty) Eval(_ *Env) Ast {
+	return e
+}
+func (e Empty) Position() Pos {
+	return e.Pos
 }
 
 // bというbyte(ASCII文字)が数字かどうか 
@@ -338,25 +755,37 @@ func skipSpace(buf []byte) []byte {
 	return []byte{}
 }
 
+// bufの先頭の文字をかえします。
+// 空のsliceのbuf[0]は範囲外アクセスでpanicしてしまうので、入力の終わり
+// では0をかえすようにしておきます。
+func peek(buf []byte) byte {
+	if len(buf) == 0 {
+		return 0
+	}
+	return buf[0]
+}
+
 // byte sliceをスキャンして数字をNum型としてとりだします。
+// intにおさまらないときはBigNum型になります。
 // nbufは次にスキャンしていくところをさします。
 // 単に文字列を数字にするなら fmt.SScanf(), strconv.Atoi()などがあります。
 // scannerというパッケージもあります。
-func getNum(buf []byte) (num Num, nbuf []byte) {
-	if !isDigit(buf[0]) {
+func getNum(buf []byte) (num Ast, nbuf []byte) {
+	if !isDigit(peek(buf)) {
 		// 先頭が数字じゃなければ panicします。
 		// byte sliceを文字列にするには string(buf)とします。
 		// stringの中身はsliceとちがって変更することができません。
 		// s := "hello"; s[0] = 'H' はエラーです。
 		// s += ", world" はできます。
-		panic("not number:" + string(buf))
+		panic(newError(SyntaxError, Pos{}, "not number", string(buf)))
 	}
 	n := int(buf[0] - '0')
 	nbuf = buf[1:] // 1バイトすすめます。
 	base := 10
 	if n == 0 {
 		// switchはこのように書くこともできます。
-		switch nbuf[0] {
+		// "0"で入力が終わっていることもあるのでpeek()を使います。
+		switch peek(nbuf) {
 		// 0b.., 0B... の場合
 		case 'b', 'B':
 			base = 2
@@ -371,27 +800,42 @@ func getNum(buf []byte) (num Num, nbuf []byte) {
 			base = 16
 			nbuf = nbuf[1:]
 		default:
-			if isDigit(nbuf[0]) {
+			if isDigit(peek(nbuf)) {
 				base = 8
 			}
 		}
 	}
+	// あふれたらbig.Intで続きを計算します。
+	var x *big.Int
 	// for文はwhileのような書きかたもできます。(whileはありません)
 	for len(nbuf) > 0 {
 		if d := digitVal(nbuf[0]); d >= 0 && d < base {
-			n = n*base + d
+			switch {
+			case x != nil:
+				x.Mul(x, big.NewInt(int64(base)))
+				x.Add(x, big.NewInt(int64(d)))
+			case n > (maxInt-d)/base:
+				x = big.NewInt(int64(n))
+				x.Mul(x, big.NewInt(int64(base)))
+				x.Add(x, big.NewInt(int64(d)))
+			default:
+				n = n*base + d
+			}
 		} else {
 			break
 		}
 		nbuf = nbuf[1:]
 	}
+	if x != nil {
+		return BigNum{x}, nbuf
+	}
 	return Num(n), nbuf
 }
 
 // byte sliceをスキャンして文字列をSymbol型としてとりだします。
 func getSymbol(buf []byte) (sym Symbol, nbuf []byte) {
-	if !isAlpha(buf[0]) && buf[0] != '.' {
-		panic("not symbol:" + string(buf))
+	if c := peek(buf); !isAlpha(c) && c != '.' {
+		panic(newError(SyntaxError, Pos{}, "not symbol", string(buf)))
 	}
 	// for i := 1; i < len(buf); i++ { .. } とかくと i のスコープは
 	// forの中だけになってしまいます。
@@ -407,137 +851,599 @@ func getSymbol(buf []byte) (sym Symbol, nbuf []byte) {
 }
 
 // 四則演算の簡単な再帰降下パーザです。
-// stmt := expr '\n' | symbol '=' expr '\n'
-// expr := [+|-] term ([+|-] term)
-// term := factor ([*|/] factor)
-// factor := num | symbol | '(' expr ')' | symbol'(' expr ')'
+// script := stmt ([';'|'\n'] stmt)
+// stmt := [expr | symbol ['='|':='|assignop] expr |
+//          symbol ['++'|'--'] | symbol '(' args ')' '=' expr]
+// assignop := ['+='|'-='|'*='|'/='|'%='|'**='|
+//              '<<='|'>>='|'&='|'|='|'^='|'&^=']
+// expr := params expr | or ['?' expr ':' expr]
+// params := symbol '->' | '(' [symbol (',' symbol)] ')' '->'
+// or := and ('||' and)
+// and := comparison ('&&' comparison)
+// comparison := sum ([==|!=|<|<=|>|>=] sum)
+// sum := term ([+|-|'|'|^] term)
+// term := unary ([*|/|%|<<|>>|&|&^] unary)
+// unary := [+|-|~|!] unary | power
+// power := factor ['**' unary]
+// factor := num | string | bool | symbol | '(' expr ')' | symbol'(' args ')' |
+//           '[' args ']' | 'if' expr 'then' expr 'else' expr | let
+// let := 'let' symbol '=' expr (',' symbol '=' expr) 'in' expr
+// args := [expr (',' expr)]
 // より複雑な文法はgoyaccなどを使ったほうがいいでしょう。
 // goパッケージがgoのパーザを含んでいるのでそれも参考になります。
 
-// stmt := expr '\n' | symbol '=' expr '\n'
-// をbufからよんで、stmtをあらわすAstと、次のよむsliceをかえします。
-func parseStatement(buf []byte) (stmt Ast, nbuf []byte) {
-	buf = skipSpace(buf)
-	stmt, nbuf = parseExpression(buf)
-	nbuf = skipSpace(nbuf)
-	if nbuf[0] == '=' {
+// パーザの状態です。
+// Lexerが読んだトークンを1つ先読みしながら構文を解析していきます。
+type parser struct {
+	lex   *Lexer
+	tok   Token // 次に読むトークン
+	last  Token // 最後に読んだトークン
+	depth int   // 入れ子の深さ
+}
+
+// 入れ子にできる式の深さの上限です。
+// 再帰降下パーザは入れ子が深くなるとそのぶん関数を呼ぶので、
+// (((...))) や ----x が長すぎるとスタックがあふれてしまいます。
+// スタックがあふれるとrecover()できずにプログラムごと終了してしまう
+// ので、その前に文法エラーにします。
+const maxNesting = 1000
+
+// 入れ子を1つ深くします。深すぎたらstartからの文法エラーにします。
+// defer p.leave() と組にして使います。
+func (p *parser) enter(start Pos) {
+	p.depth++
+	if p.depth > maxNesting {
+		panic(newError(SyntaxError, start,
+			"expression too deeply nested", ""))
+	}
+}
+
+// 入れ子を1つ浅くします。
+func (p *parser) leave() {
+	p.depth--
+}
+
+func newParser(b []byte) *parser {
+	p := &parser{lex: NewLexer(b)}
+	p.next()
+	return p
+}
+
+// 次のトークンにすすみます。
+func (p *parser) next() {
+	p.last = p.tok
+	p.tok = p.lex.Next()
+}
+
+// 次のトークンがkindの種類で、textsのどれかかどうか。
+// ...string と書くと、いくつでも文字列をうけとれます。
+// textsはstringのsliceになります。
+func (p *parser) is(kind TokenKind, texts ...string) bool {
+	if p.tok.Kind != kind {
+		return false
+	}
+	for _, text := range texts {
+		if p.tok.Text == text {
+			return true
+		}
+	}
+	return len(texts) == 0
+}
+
+// 式の終わりかどうか。入力の終わりか改行までが1つの式です。
+func (p *parser) atEnd() bool {
+	return p.tok.Kind == TokNewline || p.tok.Kind == TokEOF
+}
+
+// 文の終わりかどうか。1 + 2; 3 * 4 のように';'で区切ると、1行に
+// いくつも文を書けます。
+// ';'のあとに続きはないので、atEnd()とちがって1 + ; はIncompleteError
+// ではなく文法エラーです。
+func (p *parser) atStmtEnd() bool {
+	return p.atEnd() || p.tok.Kind == TokSemicolon
+}
+
+// 改行を読みとばします。
+// 1 + のように式の途中で行が終わっているときは、続きは次の行にあると
+// みなします。
+func (p *parser) skipNewlines() {
+	for p.tok.Kind == TokNewline {
+		p.next()
+	}
+}
+
+// startから最後に読んだトークンまでの位置をかえします。
+func (p *parser) span(start Pos) Pos {
+	start.End = p.last.Pos.End
+	return start
+}
+
+// ')' を読みます。なければstartからのエラーにします。
+// 行の終わりまできているなら、次の行に続きがあるかもしれないので
+// IncompleteErrorにします。
+func (p *parser) closeParen(start Pos, msg string) {
+	p.skipNewlines()
+	if p.tok.Kind != TokRParen {
+		kind := SyntaxError
+		if p.atEnd() {
+			kind = IncompleteError
+		}
+		pos := p.span(start)
+		panic(newError(kind, pos, msg, pos.Text()))
+	}
+	p.next()
+}
+
+// kindの種類でtextのトークンを読みます。なければstartからのエラーに
+// します。closeParen()とおなじように、行の終わりならIncompleteErrorに
+// します。
+func (p *parser) expect(kind TokenKind, text string, start Pos) {
+	p.skipNewlines()
+	if !p.is(kind, text) {
+		errKind := SyntaxError
+		if p.atEnd() {
+			errKind = IncompleteError
+		}
+		pos := p.span(start)
+		panic(newError(errKind, pos, "missing "+text, pos.Text()))
+	}
+	p.next()
+}
+
+// stmt := [expr | symbol ['='|':='|assignop] expr |
+//          symbol ['++'|'--'] | symbol '(' args ')' '=' expr]
+// assignop := ['+='|'-='|'*='|'/='|'%='|'**='|
+//              '<<='|'>>='|'&='|'|='|'^='|'&^=']
+// を読んで、stmtをあらわすAstをかえします。
+// 文のあとの';'や'\n'は読みません。
+func (p *parser) parseStatement() (stmt Ast) {
+	start := p.tok.Pos
+	if p.atStmtEnd() {
+		// 空行や ;; の間はなにもしない文です。
+		start.End = start.Start
+		return Empty{Pos: start}
+	}
+	if stmt, ok := p.parseIncrement(start); ok {
+		return stmt
+	}
+	stmt = p.parseExpression()
+	if p.is(TokOp, "=") {
 		// もし symbol '=' の場合
-		if sym, ok := stmt.(Symbol); ok {
-			var expr Ast
-			expr, nbuf = parseExpression(nbuf[1:])
+		if sym, ok := bare(stmt).(Symbol); ok {
+			p.next()
+			expr := p.parseExpression()
 			// 代入式としてあつかいます。
-			stmt = AssignOp{Var: sym, Expr: expr}
+			stmt = AssignOp{Var: sym, Expr: expr, Pos: p.span(start)}
+		} else if call, ok := stmt.(FunCall); ok {
+			// symbol '(' args ')' '=' の場合は関数定義です。
+			p.next()
+			body := p.parseExpression()
+			stmt = newFuncDef(call, body, p.span(start))
 		} else {
 			// '=' の左はSymbol以外だと例外処理にします。
-			panic(fmt.Sprintf("lvalue is not symbol:%s", stmt))
-		}
-	}
-	return stmt, nbuf
-}
-
-// expr := [+|-] term ([+|-] term)
-// をbufからよんで、exprをあらわすAstと、次のよむsliceをかえします。
-func parseExpression(buf []byte) (expr Ast, nbuf []byte) {
-	buf = skipSpace(buf)
-	var uniop byte
-	if buf[0] == '+' || buf[0] == '-' {
-		uniop = buf[0] // '+' か '-'
-		buf = buf[1:]  // 1バイトすすめる
-	}
-	expr, nbuf = parseTerm(buf)
-	if uniop == '-' {
-		// '-' term だったら UnaryOpをつくる
-		// '+' term は termとおなじなのでなにもしません。
-		expr = UnaryOp{Op: '-', Expr: expr}
-	}
-	nbuf = skipSpace(nbuf)
-	for nbuf[0] == '+' || nbuf[0] == '-' {
-		op := nbuf[0]
-		var term Ast
-		term, nbuf = parseTerm(nbuf[1:])
-		expr = BinOp{Op: op, Left: expr, Right: term}
-		nbuf = skipSpace(nbuf)
-	}
-	return expr, nbuf
-}
-
-// term := factor ([*|/] factor)
-// をbufからよんで、termをあらわすAstと、次のよむsliceをかえします。
-func parseTerm(buf []byte) (term Ast, nbuf []byte) {
-	buf = skipSpace(buf)
-	term, nbuf = parseFactor(buf)
-	nbuf = skipSpace(nbuf)
-	for nbuf[0] == '*' || nbuf[0] == '/' {
-		op := nbuf[0]
-		var factor Ast
-		factor, nbuf = parseFactor(nbuf[1:])
-		term = BinOp{Op: op, Left: term, Right: factor}
-		nbuf = skipSpace(nbuf)
-	}
-	return term, nbuf
-}
-
-// factor := num | symbol | '(' expr ')' | symbol'(' expr ')'
-// をbufからよんで、factorをあらわすAstと、次のよむsliceをかえします。
-func parseFactor(buf []byte) (factor Ast, nbuf []byte) {
-	buf = skipSpace(buf)
-	// switch は次のように書くこともできます。
-	switch ch := buf[0]; {
-	case ch == '(': // '(' expr ')' の場合
-		factor, nbuf = parseExpression(buf[1:])
-		nbuf = skipSpace(nbuf)
-		if nbuf[0] != ')' {
-			panic("unbalanced paren: " + string(buf))
-		}
-		return factor, nbuf[1:]
-	case isDigit(ch): // 数字の場合
-		return getNum(buf)
-	case isAlpha(ch) || ch == '.': // symbolの場合
-		var sym Symbol
-		sym, nbuf = getSymbol(buf)
-		nbuf = skipSpace(nbuf)
-		if nbuf[0] == '(' { // symbol '(' expr ')' の場合
-			var expr Ast
-			expr, nbuf = parseExpression(nbuf[1:])
-			nbuf = skipSpace(nbuf)
-			if nbuf[0] != ')' {
-				panic("unbalanced paren for func:" + string(sym))
+			panic(newError(SyntaxError, PosOf(stmt),
+				"lvalue is not symbol", stmt.String()))
+		}
+	} else if p.is(TokOp, ":=") {
+		// symbol ':=' の場合は値の代入です。関数定義はできません。
+		sym, ok := bare(stmt).(Symbol)
+		if !ok {
+			panic(newError(SyntaxError, PosOf(stmt),
+				"lvalue is not symbol", stmt.String()))
+		}
+		p.next()
+		expr := p.parseExpression()
+		stmt = AssignOp{Var: sym, Expr: expr, Eager: true, Pos: p.span(start)}
+	} else if p.is(TokOp, assignOps...) {
+		// symbol '+=' などの場合は、演算してから代入します。
+		sym, ok := bare(stmt).(Symbol)
+		if !ok {
+			panic(newError(SyntaxError, PosOf(stmt),
+				"lvalue is not symbol", stmt.String()))
+		}
+		op := strings.TrimRight(p.tok.Text, "=")
+		p.next()
+		expr := p.parseExpression()
+		stmt = AssignOp{Var: sym, Expr: expr, Op: op, Pos: p.span(start)}
+	}
+	return stmt
+}
+
+// 演算してから代入する演算子です。
+var assignOps = []string{
+	"+=", "-=", "*=", "/=", "%=", "**=",
+	"<<=", ">>=", "&=", "|=", "^=", "&^=",
+}
+
+// symbol ['++'|'--'] [';'|'\n'] を読みます。x++ は x += 1 とおなじです。
+// 1--2 のような式もあるので、'+'か'-'が2つならんで行が終わっている
+// ときだけにします。ちがったら読む前にもどします。
+func (p *parser) parseIncrement(start Pos) (stmt Ast, ok bool) {
+	saved, lex := *p, *p.lex
+	defer func() {
+		if !ok {
+			*p, *p.lex = saved, lex
+		}
+	}()
+	if p.tok.Kind != TokIdent {
+		return nil, false
+	}
+	sym := Symbol(p.tok.Text)
+	p.next()
+	if !p.is(TokOp, "+", "-") {
+		return nil, false
+	}
+	op, opPos := p.tok.Text, p.tok.Pos
+	p.next()
+	if !p.is(TokOp, op) {
+		return nil, false
+	}
+	opPos.End = p.tok.Pos.End
+	p.next()
+	if !p.atStmtEnd() {
+		return nil, false
+	}
+	one := Atom{Value: Num(1), Pos: opPos}
+	return AssignOp{Var: sym, Expr: one, Op: op, Pos: p.span(start)}, true
+}
+
+// 演算子の優先順位はGoとおなじです。** はGoにはないので、単項の
+// マイナスより強くして -2**2 が -4 になるようにしています。
+//  高い  **
+//        単項の + - ~ !
+//        * / % << >> & &^
+//        + - | ^
+//        == != < <= > >=
+//        &&
+//        ||
+//  低い  ? :
+
+// expr := params expr | or ['?' expr ':' expr]
+// を読んで、exprをあらわすAstをかえします。
+// a ? b : c ? d : e は a ? b : (c ? d : e) になります。
+func (p *parser) parseExpression() (expr Ast) {
+	start := p.tok.Pos
+	p.enter(start)
+	defer p.leave()
+	if params, ok := p.parseParams(); ok {
+		body := p.parseExpression()
+		return Lambda{Params: params, Body: body, Pos: p.span(start)}
+	}
+	expr = p.parseOr()
+	if !p.is(TokOp, "?") {
+		return expr
+	}
+	p.next()
+	then := p.parseExpression()
+	p.expect(TokOp, ":", start)
+	els := p.parseExpression()
+	return IfExpr{Cond: expr, Then: then, Else: els, Pos: p.span(start)}
+}
+
+// params := symbol '->' | '(' [symbol (',' symbol)] ')' '->'
+// を読んで、無名関数の引数をかえします。
+// (x + 1) のように無名関数でなければ、読んだトークンをもどしてokを
+// falseにします。
+func (p *parser) parseParams() (params []Symbol, ok bool) {
+	start := p.tok.Pos
+	// parserとLexerをコピーしておけば、あとでもとにもどせます。
+	saved, lex := *p, *p.lex
+	defer func() {
+		if !ok {
+			*p, *p.lex = saved, lex
+		}
+	}()
+	switch p.tok.Kind {
+	case TokIdent:
+		params = append(params, Symbol(p.tok.Text))
+		p.next()
+	case TokLParen:
+		p.next()
+		for p.tok.Kind == TokIdent {
+			params = append(params, Symbol(p.tok.Text))
+			p.next()
+			if p.tok.Kind != TokComma {
+				break
+			}
+			p.next()
+		}
+		if p.tok.Kind != TokRParen {
+			return nil, false
+		}
+		p.next()
+	default:
+		return nil, false
+	}
+	if !p.is(TokOp, "->") {
+		return nil, false
+	}
+	p.next()
+	for i, sym := range params {
+		for _, prev := range params[:i] {
+			if prev == sym {
+				pos := p.span(start)
+				panic(newError(SyntaxError, pos,
+					"duplicate parameter "+string(sym), pos.Text()))
 			}
+		}
+	}
+	return params, true
+}
+
+// or := and ('||' and)
+// を読んで、orをあらわすAstをかえします。
+func (p *parser) parseOr() (expr Ast) {
+	start := p.tok.Pos
+	expr = p.parseAnd()
+	for p.is(TokOp, "||") {
+		p.next()
+		and := p.parseAnd()
+		expr = BinOp{Op: "||", Left: expr, Right: and, Pos: p.span(start)}
+	}
+	return expr
+}
+
+// and := comparison ('&&' comparison)
+// を読んで、andをあらわすAstをかえします。
+func (p *parser) parseAnd() (and Ast) {
+	start := p.tok.Pos
+	and = p.parseComparison()
+	for p.is(TokOp, "&&") {
+		p.next()
+		cmp := p.parseComparison()
+		and = BinOp{Op: "&&", Left: and, Right: cmp, Pos: p.span(start)}
+	}
+	return and
+}
+
+// comparison := sum ([==|!=|<|<=|>|>=] sum)
+// を読んで、comparisonをあらわすAstをかえします。
+func (p *parser) parseComparison() (cmp Ast) {
+	start := p.tok.Pos
+	cmp = p.parseSum()
+	for p.is(TokOp, "==", "!=", "<", "<=", ">", ">=") {
+		op := p.tok.Text
+		p.next()
+		sum := p.parseSum()
+		cmp = BinOp{Op: op, Left: cmp, Right: sum, Pos: p.span(start)}
+	}
+	return cmp
+}
+
+// sum := term ([+|-|'|'|^] term)
+// を読んで、sumをあらわすAstをかえします。
+func (p *parser) parseSum() (expr Ast) {
+	start := p.tok.Pos
+	expr = p.parseTerm()
+	for p.is(TokOp, "+", "-", "|", "^") {
+		op := p.tok.Text
+		p.next()
+		term := p.parseTerm()
+		expr = BinOp{Op: op, Left: expr, Right: term, Pos: p.span(start)}
+	}
+	return expr
+}
+
+// term := unary ([*|/|%|<<|>>|&|&^] unary)
+// を読んで、termをあらわすAstをかえします。
+func (p *parser) parseTerm() (term Ast) {
+	start := p.tok.Pos
+	term = p.parseUnary()
+	for p.is(TokOp, "*", "/", "%", "<<", ">>", "&", "&^") {
+		op := p.tok.Text
+		p.next()
+		factor := p.parseUnary()
+		term = BinOp{Op: op, Left: term, Right: factor, Pos: p.span(start)}
+	}
+	return term
+}
+
+// unary := [+|-|~|!] unary | power
+// を読んで、unaryをあらわすAstをかえします。
+// 2 * -3 や --x のように、単項演算子は項のどこにでも書けます。
+func (p *parser) parseUnary() Ast {
+	start := p.tok.Pos
+	p.enter(start)
+	defer p.leave()
+	if p.is(TokOp, "+", "-", "~", "!") {
+		op := p.tok.Text
+		p.next()
+		expr := p.parseUnary()
+		if op == "+" {
+			// '+' unary は unaryとおなじなのでなにもしません。
+			return expr
+		}
+		return UnaryOp{Op: op, Expr: expr, Pos: p.span(start)}
+	}
+	return p.parsePower()
+}
+
+// power := factor ['**' unary]
+// を読んで、powerをあらわすAstをかえします。
+// 右辺をunaryとして読むので、2**3**2 は 2**(3**2) になり、2**-1 も
+// 書けます。
+func (p *parser) parsePower() Ast {
+	start := p.tok.Pos
+	base := p.parseFactor()
+	if !p.is(TokOp, "**") {
+		return base
+	}
+	p.next()
+	exp := p.parseUnary()
+	return BinOp{Op: "**", Left: base, Right: exp, Pos: p.span(start)}
+}
+
+// factor := num | string | bool | symbol | '(' expr ')' | symbol'(' args ')' |
+//           '[' args ']' | 'if' expr 'then' expr 'else' expr | let
+// を読んで、factorをあらわすAstをかえします。
+func (p *parser) parseFactor() (factor Ast) {
+	p.skipNewlines()
+	start := p.tok.Pos
+	if p.atEnd() {
+		// 1 + のように式の途中で入力が終わっています。
+		// 続きを読めば正しい式になるかもしれないので、ただの文法
+		// エラーとは区別します。
+		panic(newError(IncompleteError, start,
+			"unexpected end of input", ""))
+	}
+	// switch は次のように書くこともできます。
+	switch tok := p.tok; tok.Kind {
+	case TokLParen: // '(' expr ')' の場合
+		p.next()
+		factor = p.parseExpression()
+		p.closeParen(start, "unbalanced paren")
+		return factor
+	case TokLBracket: // '[' args ']' の場合
+		p.next()
+		elems := p.parseArgs(TokRBracket)
+		p.expect(TokRBracket, "]", start)
+		return Atom{Value: List(elems), Pos: p.span(start)}
+	case TokString: // 文字列の場合
+		p.next()
+		return Atom{Value: stringLiteral(tok.Text, tok.Pos), Pos: tok.Pos}
+	case TokNum: // 数字の場合
+		num, rest := getNumber([]byte(tok.Text))
+		if len(rest) > 0 {
+			// 255u8 のように後ろに型の名前がついています。
+			num = fixedLiteral(num, string(rest), tok)
+		}
+		p.next()
+		return Atom{Value: num, Pos: tok.Pos}
+	case TokIdent: // symbolの場合
+		sym := Symbol(tok.Text)
+		p.next()
+		if sym == "let" { // 'let' symbol '=' expr ... 'in' expr の場合
+			return p.parseLet(start)
+		}
+		if sym == "if" { // 'if' expr 'then' expr 'else' expr の場合
+			cond := p.parseExpression()
+			p.expect(TokIdent, "then", start)
+			then := p.parseExpression()
+			p.expect(TokIdent, "else", start)
+			els := p.parseExpression()
+			return IfExpr{Cond: cond, Then: then, Else: els,
+				Pos: p.span(start)}
+		}
+		if sym == "true" || sym == "false" {
+			return Atom{Value: Bool(sym == "true"), Pos: tok.Pos}
+		}
+		if p.tok.Kind == TokLParen { // symbol '(' args ')' の場合
+			p.next()
+			args := p.parseArgs(TokRParen)
+			p.closeParen(start, "unbalanced paren for func")
 			// FunCallを作ります。
-			return FunCall{Func: sym, Expr: expr}, nbuf[1:]
+			return FunCall{Func: sym, Args: args, Pos: p.span(start)}
+		}
+		return Atom{Value: sym, Pos: tok.Pos}
+	}
+	panic(newError(SyntaxError, start, "unexpected token", p.tok.Text))
+}
+
+// let := 'let' symbol '=' expr (',' symbol '=' expr) 'in' expr
+// を読んで、letをあらわすAstをかえします。'let'は読んだあとです。
+func (p *parser) parseLet(start Pos) Ast {
+	var let LetExpr
+	for {
+		if p.tok.Kind != TokIdent {
+			p.expect(TokIdent, "variable", start)
+		}
+		let.Names = append(let.Names, Symbol(p.tok.Text))
+		p.next()
+		p.expect(TokOp, "=", start)
+		let.Exprs = append(let.Exprs, p.parseExpression())
+		if p.tok.Kind != TokComma {
+			break
 		}
-		return sym, nbuf
+		p.next()
 	}
-	panic("unepxected token:" + string(buf))
+	p.expect(TokIdent, "in", start)
+	let.Body = p.parseExpression()
+	let.Pos = p.span(start)
+	return let
+}
+
+// args := [expr (',' expr)]
+// を読んで、引数のsliceをかえします。rand() のように引数がなければ
+// 空のsliceです。endは引数のあとにくるトークンの種類です。
+func (p *parser) parseArgs(end TokenKind) (args []Ast) {
+	if p.tok.Kind == end {
+		return args
+	}
+	args = append(args, p.parseExpression())
+	for p.tok.Kind == TokComma {
+		p.next()
+		args = append(args, p.parseExpression())
+	}
+	return args
 }
 
 // byte sliceを読んでAst型にします。
 // 大文字ではじまっているのでパッケージの外から呼びだせます。
+// 読んだ式にはbの先頭からの位置情報がつきます。
+// 空行からはEmptyを読みます。式の途中でbが終わっていた場合は
+// IncompleteErrorの*Errorでpanicします。
 func Read(b []byte) (ast Ast, nbuf []byte) {
-	return parseStatement(b)
+	p := newParser(b)
+	ast = p.parseStatement()
+	// 先読みしたトークンから後が残りです。
+	return ast, b[p.tok.Pos.Start:]
+}
+
+// byte sliceを最後まで読んで、文のsliceにします。
+// 文は';'か改行で区切ります。空の文はふくみません。
+// それぞれの文にはbの先頭からの位置情報がつくので、ファイルに書いた
+// 計算を読んで、エラーの場所を行と桁で知らせることができます。
+func ReadAll(b []byte) (stmts []Ast) {
+	p := newParser(b)
+	for p.tok.Kind != TokEOF {
+		stmt := p.parseStatement()
+		if !p.atStmtEnd() {
+			// 1 2 のように文のあとに区切りがありません。
+			panic(newError(SyntaxError, p.tok.Pos,
+				"unexpected token", p.tok.Text))
+		}
+		p.next()
+		if _, ok := stmt.(Empty); !ok {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts
 }
 
 // Astを評価してAstをかえします。
 // 大文字ではじまっているのでパッケージの外から呼びだせます。
 func Eval(ast Ast, env *Env) (v Ast) {
 	v = ast.Eval(env)
-	if s, ok := ast.(Symbol); ok && string(s) == "_" {
+	if s, ok := bare(ast).(Symbol); ok && string(s) == "_" {
+	} else if _, ok := ast.(Empty); ok {
+		// 空行は _ をかえません。
 	} else {
-		// さっきの式を _ で参照できるようにセットしておきます。
-		SetExpr(env, "_", ast)
+		// さっきの値を _ で参照できるようにセットしておきます。
+		// 式のままだと _ + 1 の _ が循環したり、_ で代入をもう一度
+		// 実行したりしてしまうので、評価ずみの値にします。
+		SetExpr(env, "_", Value{v})
 	}
 	return v
 }
 
+// 文のsliceを順に評価して、結果のsliceをかえします。
+// ReadAll()で読んだ文をまとめて実行するのに使います。
+func EvalAll(stmts []Ast, env *Env) (vs []Ast) {
+	for _, stmt := range stmts {
+		vs = append(vs, Eval(stmt, env))
+	}
+	return vs
+}
+
 // Astを文字列にします。
 // 大文字ではじまっているのでパッケージの外から呼びだせます。
 func Print(v Ast, env *Env) string {
-	// Num型の場合 .printBaseの値によって基数をかえます。
-	if n, ok := v.(Num); ok {
+	// Num型とBigNum型の場合 .printBaseの値によって基数をかえます。
+	if isInteger(v) {
 		var format string
-		// もし多値をかえす関数で使わない返り値があるときは
-		// _ でうけとります。
-		base, _ := envValue(env, ".printBase")
+		// NewEnv()を使わずに作ったEnvのように設定がなければ、
+		// 10進数で表示します。
+		base := envValueOr(env, ".printBase", 10)
 		switch base {
 		case 2:
 			format = "0b%b"
@@ -548,29 +1454,45 @@ func Print(v Ast, env *Env) string {
 		case 16:
 			format = "0x%x"
 		default:
-			panic(fmt.Sprintf("bad .printBase: %d",
-				env.Var[".printBase"]))
+			panic(badSetting(env, ".printBase"))
 		}
-		return fmt.Sprintf(format, int(n))
+		// big.Intもfmtの%b, %o, %d, %xで表示できます。
+		return fmt.Sprintf(format, toBig(v))
+	}
+	switch n := v.(type) {
+	case Rational:
+		return printRational(n, env)
+	case Float:
+		return printFloat(n, env)
+	case Decimal:
+		return n.String()
+	case Complex:
+		return printComplex(n, env)
+	case Fixed:
+		return printFixed(n, env)
+	case List:
+		return printList(n, env)
+	case String:
+		return string(n)
 	}
 	return v.String()
 }
 
 func DumpAst(v Ast, env *Env) Ast {
-	if s, ok := v.(Symbol); ok {
-		if e, found := env.Var[string(s)]; found {
-			return Symbol(fmt.Sprintf("%#v", e))
+	if s, ok := bare(v).(Symbol); ok {
+		if e, owner := lookup(env, string(s)); owner != nil {
+			return String(fmt.Sprintf("%#v", bare(e)))
 		}
 	}
 	// %#v を使うと型情報つきで pretty printできます。
-	return Symbol(fmt.Sprintf("%#v", v))
+	return String(fmt.Sprintf("%#v", bare(v)))
 }
 
 func PrintAst(v Ast, env *Env) Ast {
-	if s, ok := v.(Symbol); ok {
-		if e, found := env.Var[string(s)]; found {
-			return Symbol(e.String())
+	if s, ok := bare(v).(Symbol); ok {
+		if e, owner := lookup(env, string(s)); owner != nil {
+			return String(e.String())
 		}
 	}
-	return Symbol(v.String())
+	return String(v.String())
 }
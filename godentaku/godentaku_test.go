@@ -0,0 +1,783 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+// gotest でテストを実行します。
+// _test.goで終わるファイルはパッケージのビルドにはふくまれず、
+// gotestのときだけコンパイルされます。
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// inputを読んで順に評価して、最後の文の値を表示用の文字列にします。
+func run(env *Env, input string) (s string, err os.Error) {
+	stmts, err := TryReadAll([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	vs, err := TryEvalAll(stmts, env)
+	if err != nil || len(vs) == 0 {
+		return "", err
+	}
+	return TryPrint(vs[len(vs)-1], env)
+}
+
+// エラーの種類をかえします。*Errorでなければ-1です。
+func errorKind(err os.Error) ErrorKind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return -1
+}
+
+// 入力と、最後の文を評価して表示した結果の組です。
+type evalTest struct {
+	in, out string
+}
+
+// それぞれの入力を新しいEnvで評価して、結果をくらべます。
+func checkEval(t *testing.T, tests []evalTest) {
+	for _, tt := range tests {
+		out, err := run(NewEnv(), tt.in)
+		if err != nil {
+			t.Errorf("%q: unexpected error %s", tt.in, err)
+			continue
+		}
+		if out != tt.out {
+			t.Errorf("%q = %q; want %q", tt.in, out, tt.out)
+		}
+	}
+}
+
+// 入力と、評価したときにおきるエラーの種類の組です。
+type errorTest struct {
+	in   string
+	kind ErrorKind
+}
+
+func checkError(t *testing.T, tests []errorTest) {
+	for _, tt := range tests {
+		out, err := run(NewEnv(), tt.in)
+		if err == nil {
+			t.Errorf("%q = %q; want %s", tt.in, out, tt.kind)
+			continue
+		}
+		if errorKind(err) != tt.kind {
+			t.Errorf("%q: error %s; want %s", tt.in, err, tt.kind)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"1 + 2", "3"},
+		{"x = 3; x * 2", "6"},
+		{"x", "x"},
+	})
+	checkError(t, []errorTest{
+		{"1 +* 2", SyntaxError},
+		{")", SyntaxError},
+		{"1 = 2", SyntaxError},
+		{"nosuch(1)", NameError},
+		{".printBase = 3; 1", ValueError},
+		// 入れ子が深すぎる式はスタックがあふれる前にエラーにします。
+		{strings.Repeat("(", 10000) + "1" + strings.Repeat(")", 10000),
+			SyntaxError},
+		{strings.Repeat("-", 10000) + "1", SyntaxError},
+	})
+}
+
+func TestDiagnose(t *testing.T) {
+	for _, tt := range []evalTest{
+		{"1 + (1+2", "1:5: incomplete input: unbalanced paren: (1+2\n" +
+			"1 + (1+2\n" +
+			"    ^~~~"},
+		{"a\n1 +* 2", "2:4: syntax error: unexpected token: *\n" +
+			"1 +* 2\n" +
+			"   ^"},
+		// タブはそのまま残して、桁がずれないようにします。
+		{"\t1 + nosuch(2)", "1:6: name error: no such function: nosuch\n" +
+			"\t1 + nosuch(2)\n" +
+			"\t    ^~~~~~~~~"},
+	} {
+		_, err := run(NewEnv(), tt.in)
+		if got := Diagnose(err); got != tt.out {
+			t.Errorf("Diagnose(%q) =\n%s\nwant\n%s", tt.in, got, tt.out)
+		}
+	}
+	// 位置のないエラーはそのまま表示します。
+	err := newError(ValueError, Pos{}, "bad .printBase", "3")
+	if got, want := Diagnose(err), "value error: bad .printBase: 3"; got != want {
+		t.Errorf("Diagnose() = %q; want %q", got, want)
+	}
+}
+
+func TestReadEmpty(t *testing.T) {
+	for _, tt := range []struct {
+		in, rest string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{"\n", "\n"},
+	} {
+		ast, rest, err := TryRead([]byte(tt.in))
+		if err != nil {
+			t.Errorf("TryRead(%q): unexpected error %s", tt.in, err)
+			continue
+		}
+		if _, ok := ast.(Empty); !ok {
+			t.Errorf("TryRead(%q) = %v; want Empty", tt.in, ast)
+		}
+		if string(rest) != tt.rest {
+			t.Errorf("TryRead(%q) rest = %q; want %q", tt.in, rest, tt.rest)
+		}
+	}
+	// 読んだ文の後ろが残りです。
+	ast, rest, err := TryRead([]byte("1 + 2\n3"))
+	if err != nil || ast.String() != "(1 + 2)" || string(rest) != "\n3" {
+		t.Errorf("TryRead = %v, %q, %v; want (1 + 2), \"\\n3\"", ast, rest, err)
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	for _, in := range []string{
+		"1 +",
+		"(1 + 2",
+		"f(1,",
+		"x =",
+	} {
+		if _, _, err := TryRead([]byte(in)); !IsIncomplete(err) {
+			t.Errorf("TryRead(%q): error %v; want incomplete input", in, err)
+		}
+	}
+	// 続きの行があれば読めます。
+	out, err := run(NewEnv(), "(1 +\n2) * 3")
+	if err != nil || out != "9" {
+		t.Errorf("continued line = %q, %v; want \"9\"", out, err)
+	}
+	// 閉じ括弧が多いのは続きを読んでもなおりません。
+	if _, err := TryReadAll([]byte("1 + 2)")); err == nil || IsIncomplete(err) {
+		t.Errorf("TryReadAll(\"1 + 2)\"): error %v; want syntax error", err)
+	}
+}
+
+func TestLexer(t *testing.T) {
+	toks := Tokens([]byte("x = f(1, 2)\n3"))
+	want := []TokenKind{TokIdent, TokOp, TokIdent, TokLParen, TokNum,
+		TokComma, TokNum, TokRParen, TokNewline, TokNum, TokEOF}
+	if len(toks) != len(want) {
+		t.Fatalf("Tokens() = %v; want %d tokens", toks, len(want))
+	}
+	for i, tok := range toks {
+		if tok.Kind != want[i] {
+			t.Errorf("token %d = %v; want %s", i, tok, want[i])
+		}
+	}
+	if pos := toks[9].Pos; pos.Line != 2 || pos.Col != 1 {
+		t.Errorf("token 9 at %s; want 2:1", pos)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"1 + 2 * 3", "7"},
+		{"(1 + 2) * 3", "9"},
+		{"10 - 4 - 3", "3"},
+		{"--3", "3"},
+		{"1--2", "3"},
+		{"2 * -3", "-6"},
+	})
+}
+
+func TestBigNum(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"123456789012345678901234567890", "123456789012345678901234567890"},
+		{fmt.Sprintf("%d + 1", maxInt), fmt.Sprintf("%d", uint(maxInt)+1)},
+		{fmt.Sprintf("%d - 2", minInt+1), "-" + fmt.Sprintf("%d", uint(maxInt)+2)},
+		{fmt.Sprintf("%d * 2 - %d", maxInt, maxInt), fmt.Sprintf("%d", maxInt)},
+		{"0xffffffffffffffffffff", "1208925819614629174706175"},
+	})
+}
+
+func TestRational(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"4 / 2", "2"},
+		{"1 / 3", "1/3"},
+		{"6 / 4", "3/2"},
+		{"1/3 + 2/3", "1"},
+		{"num(6/4)", "3"},
+		{"den(6/4)", "2"},
+		{"num(-1/2)", "-1"},
+		{"den(3)", "1"},
+		{"num(x)", "num(x)"},
+		{".printRational = mixed; 4/3", "1 1/3"},
+		{".printRational = decimal; 2/3", "0.6666666667"},
+		{".printRational = decimal; .printDigits = 3; 2/3", "0.667"},
+		{".printRational = undef; 4/3", "4/3"},
+	})
+	checkError(t, []errorTest{
+		{"1 / 0", DivisionError},
+		{`num("a")`, TypeError},
+		{".printRational = nosuch; 1/2", ValueError},
+	})
+}
+
+func TestFloat(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"3.14", "3.14"},
+		{"1e3", "1000"},
+		{"1.5e-2", "0.015"},
+		{"0.1 + 0.2", "0.30000000000000004"},
+		{"1/2 + 0.5", "1"},
+		{"1.0 / 0", "+Inf"},
+		{".printPrecision = 3; 3.14159", "3.14"},
+		{".printPrecision = undef; 3.14159", "3.14159"},
+	})
+	// NewEnv()を使わずに作ったEnvでも表示できます。
+	env := &Env{Var: map[string]Ast{".printBase": Num(10)},
+		Func: map[string]func(Ast, *Env) Ast{}}
+	for _, tt := range []evalTest{
+		{"3.14159", "3.14159"},
+		{"1.5", "1.5"},
+		{"4/3", "4/3"},
+	} {
+		out, err := run(env, tt.in)
+		if err != nil || out != tt.out {
+			t.Errorf("%q = %q, %v; want %q", tt.in, out, err, tt.out)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	checkEval(t, []evalTest{
+		{".decimal = 1; 0.1 + 0.2", "0.3"},
+		{".decimal = 1; 1 / 3", "0.33333333333333333333"},
+		{".decimal = 1; .decimalScale = 2; 1 / 3", "0.33"},
+		{".decimal = 1; 10 / 4", "2.5"},
+		{".decimal = 1; 1.00 / 2", "0.50"},
+		{".decimal = 1; 1.005 * 3", "3.015"},
+		// 設定がなければdefaultの設定とおなじです。
+		{".decimal = 1; .decimalScale = undef; 1 / 3",
+			"0.33333333333333333333"},
+		{".decimal = 1; .rounding = undef; 2.5 + 0", "2.5"},
+		{".decimal = 1; .rounding = undef; round(2.5)", "2"},
+	})
+	checkError(t, []errorTest{
+		{".decimal = 1; 1e-9223372036854775808", SyntaxError},
+		{".decimal = 1; x := 1e4000000; x := x*x*x*x*x*x*x*x; x := x*x*x*x",
+			ValueError},
+		{".decimal = 1; .rounding = nosuch; round(2.5)", ValueError},
+		// 設定の式の小数がまた.decimalを調べるので循環します。
+		{".decimal = 0.5 > 1", CycleError},
+	})
+	// 循環した設定は代入されません。
+	env := NewEnv()
+	run(env, ".decimal = 1")
+	if _, err := run(env, ".decimal = 0.5 > 1"); errorKind(err) != CycleError {
+		t.Errorf(".decimal = 0.5 > 1: error %v; want cycle", err)
+	}
+	if out, err := run(env, "0.1 + 0.2"); err != nil || out != "0.3" {
+		t.Errorf("0.1 + 0.2 = %q, %v; want \"0.3\"", out, err)
+	}
+}
+
+func TestRound(t *testing.T) {
+	checkEval(t, []evalTest{
+		{".decimal = 1; round(2.5)", "2"},
+		{".decimal = 1; round(3.5)", "4"},
+		{".decimal = 1; .rounding = halfup; round(2.5)", "3"},
+		{".decimal = 1; .rounding = halfdown; round(2.5)", "2"},
+		{".decimal = 1; .rounding = down; round(-2.7)", "-2"},
+		{".decimal = 1; .rounding = up; round(2.1)", "3"},
+		{".decimal = 1; .rounding = floor; round(-2.1)", "-3"},
+		{".decimal = 1; .rounding = ceiling; round(2.1)", "3"},
+		{".decimal = 1; round(2.345, 2)", "2.34"},
+		{"floor(2.7)", "2"},
+		{"ceil(2.1)", "3"},
+		{"truncate(-2.7)", "-2"},
+		{"round(2.345, 2)", "2.35"},
+		{"round(1234, -2)", "1200"},
+		{"round(1/3, 3)", "333/1000"},
+		// float64であらわせない桁でもNaNになりません。
+		{"round(2.5, 400)", "2.5"},
+		{"round(2.5, -400)", "0"},
+		{"round(-2.5, -400)", "-0"},
+		{"round(1e300, 300)", "1e+300"},
+		{"round(0.0, 400)", "0"},
+	})
+	checkError(t, []errorTest{
+		{"round(1, 1.5)", TypeError},
+		{"round(1, 100000000)", ValueError},
+	})
+}
+
+func TestComplex(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"2i", "0+2i"},
+		{"1 + 2i", "1+2i"},
+		{"(1 + 2i) * (1 - 2i)", "5+0i"},
+		{"re(3+4i)", "3"},
+		{"im(3+4i)", "4"},
+		{"abs(3+4i)", "5"},
+		{"abs(-2)", "2"},
+		{"abs(-1/2)", "1/2"},
+		{"arg(1i)", "1.5707963267948966"},
+		{"conj(3+4i)", "3-4i"},
+		{"abs(x)", "abs(x)"},
+		{".printComplex = polar; 3+4i", "5∠0.9272952180016122"},
+		{".printComplex = polar; .printPrecision = 3; 3+4i", "5∠0.927"},
+	})
+	checkError(t, []errorTest{
+		{`abs("a")`, TypeError},
+		{".printComplex = nosuch; 1i", ValueError},
+	})
+}
+
+func TestFixed(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"255u8", "255"},
+		{"-1i8", "-1"},
+		{"200u8 + 100u8", "44"},
+		{".overflow = saturate; 200u8 + 100u8", "255"},
+		{"u8(300)", "44"},
+		{"i8(-1.5)", "-1"},
+		// 10進数以外では2の補数を型の幅まで0でうめて表示します。
+		{".printBase = 16; -1i8", "0xff"},
+		{".printBase = 2; -1i8", "0b11111111"},
+		{".printBase = 8; -1i8", "0377"},
+		{".printBase = 16; 255u16", "0x00ff"},
+		// 設定がなければdefaultの設定とおなじです。
+		{".overflow = undef; 200u8 + 100u8", "44"},
+		{".printBase = undef; -1i8", "-1"},
+	})
+	env := &Env{Var: map[string]Ast{}, Func: map[string]func(Ast, *Env) Ast{}}
+	for _, tt := range []evalTest{
+		{"200u8 + 100u8", "44"},
+		{"-1i8", "-1"},
+		{"255", "255"},
+	} {
+		out, err := run(env, tt.in)
+		if err != nil || out != tt.out {
+			t.Errorf("%q = %q, %v; want %q", tt.in, out, err, tt.out)
+		}
+	}
+	checkError(t, []errorTest{
+		{".overflow = error; 200u8 + 100u8", OverflowError},
+		{"1u8 + 1i8", TypeError},
+		{`u8("x")`, TypeError},
+	})
+}
+
+func TestBitwise(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"1 + 2 << 3", "17"},
+		{"1 | 2 & 3", "3"},
+		{"6 &^ 3", "4"},
+		{"5 ^ 3", "6"},
+		{"~0", "-1"},
+		{"1 << 100", "1267650600228229401496703205376"},
+		{"-8 >> 1", "-4"},
+		{".printBase = 2; 5", "0b101"},
+	})
+	checkError(t, []errorTest{
+		{"1 << 100000000", ValueError},
+		{"1.5 & 1", TypeError},
+	})
+}
+
+func TestPower(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"7 % 3", "1"},
+		{"-7 % 3", "-1"},
+		{"2 * 3 % 4", "2"},
+		{"-2**2", "-4"},
+		{"2**3**2", "512"},
+		{"2**-1", "1/2"},
+		{"2**64", "18446744073709551616"},
+		{"2**64 - 2**64 + 1", "1"},
+	})
+	checkError(t, []errorTest{
+		{"1 % 0", DivisionError},
+		{"2**100000000", ValueError},
+	})
+}
+
+func TestBool(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"true", "true"},
+		{"1 + 2 == 3", "true"},
+		{"1 == 1.0", "true"},
+		{"1/2 < 0.6", "true"},
+		{"1 < 2 && 2 < 3", "true"},
+		{"true || false && false", "true"},
+		{"!true || true", "true"},
+		// 左辺で決まれば右辺は評価しません。
+		{"1 == 1 || x", "true"},
+		{"false && x", "false"},
+	})
+	checkError(t, []errorTest{
+		{"1 && true", TypeError},
+		{"1 < 2 < 3", TypeError},
+		{"!1", TypeError},
+	})
+}
+
+func TestIf(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"true ? 1 : 2", "1"},
+		{"false ? 1 : true ? 2 : 3", "2"},
+		{"if 1 < 2 then 3 else 4", "3"},
+		// えらばなかったほうは評価しません。
+		{"x = 0; x != 0 ? 1 / x : 0", "0"},
+		{"x ? 1 : 2", "(x ? 1 : 2)"},
+	})
+	checkError(t, []errorTest{
+		{"if 1 then 2 else 3", TypeError},
+	})
+	for _, in := range []string{"true ? 1", "if x then 1"} {
+		if _, err := TryReadAll([]byte(in)); !IsIncomplete(err) {
+			t.Errorf("%q: error %v; want incomplete input", in, err)
+		}
+	}
+}
+
+func TestFuncN(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"max(1, 2.5, 1/2)", "2.5"},
+		{"min(3, 1, 2)", "1"},
+		{"max(1)", "1"},
+		{"clamp(5, 1, 3)", "3"},
+		{"clamp(0, 1, 3)", "1"},
+		{"mod(-7, 3)", "2"},
+		{"powmod(2, 10, 1000)", "24"},
+		// 未定義の変数があれば関数呼出のままです。
+		{"max(x, 2)", "max(x, 2)"},
+	})
+	checkError(t, []errorTest{
+		{"max()", TypeError},
+		{"mod(1)", TypeError},
+		{"clamp(1, 3, 2)", ValueError},
+		{"rand(0)", ValueError},
+		{"max(true, 2)", TypeError},
+		{`max(1, "a")`, TypeError},
+		{`round("a")`, TypeError},
+		{"mod(1, [1])", TypeError},
+	})
+	if _, err := TryReadAll([]byte("f(1,")); !IsIncomplete(err) {
+		t.Errorf("f(1,: error %v; want incomplete input", err)
+	}
+}
+
+func TestFuncDef(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"f(x) = x * 2; f(3)", "6"},
+		{"area(w, h) = w * h; area(2, 3)", "6"},
+		{"fact(n) = n <= 1 ? 1 : n * fact(n - 1); fact(20)",
+			"2432902008176640000"},
+		{"f(x) = x * 2; g(a, b) = a + b; defs()",
+			"f(x) = (x * 2)\ng(a, b) = (a + b)"},
+		{"f(x) = x * 2; f = undef; defs()", ""},
+		{".maxDepth = undef; f(x) = x * 2; f(3)", "6"},
+	})
+	checkError(t, []errorTest{
+		{"f(x) = x * 2; f = undef; f(1)", NameError},
+		{"f(x) = x; f(1, 2)", TypeError},
+		{"f(x, x) = x", SyntaxError},
+		{"f(1) = 2", SyntaxError},
+		{"f(n) = f(n + 1); f(1)", RecursionError},
+		{".maxDepth = 100000000; f(n) = f(n + 1); f(1)", ValueError},
+		{".maxDepth = undef; f(n) = f(n + 1); f(1)", RecursionError},
+	})
+}
+
+func TestLambda(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"[1, 2, 3]", "[1, 2, 3]"},
+		{"[]", "[]"},
+		{"f = x -> x * 2; f(4)", "8"},
+		{"apply(x -> x * 2, [4])", "8"},
+		{"adder(n) = x -> x + n; add3 = adder(3); add3(4)", "7"},
+		{"map(x -> x * x, [1, 2, 3])", "[1, 4, 9]"},
+		{"filter(x -> x % 2 == 0, [1, 2, 3, 4])", "[2, 4]"},
+		{"reduce((a, b) -> a + b, [1, 2, 3], 0)", "6"},
+		{"apply(max, [3, 1, 2])", "3"},
+		// 組込みの関数とおなじ名前の変数は関数として呼びません。
+		{"min = 5; min(3, 1)", "1"},
+	})
+	checkError(t, []errorTest{
+		{"filter(x -> x, [1])", TypeError},
+		{"(x, x) -> x", SyntaxError},
+		{"[1] + 1", TypeError},
+	})
+}
+
+func TestScope(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"let a = 2, b = a + 1 in a * b", "6"},
+		{"x = 1; let x = 2 in x + 1", "3"},
+		{"x = 1; let x = 2, y = x in y", "2"},
+		{"let a = 1 in let b = a + 1 in a + b", "3"},
+		{"f(x) = let y = x * 2 in y + 1; f(3)", "7"},
+		// 関数の中の変数は呼出元からは見えません。
+		{"f(x) = y; g(y) = f(1); g(2)", "y"},
+	})
+	if _, err := TryReadAll([]byte("let a = 1")); !IsIncomplete(err) {
+		t.Errorf("let a = 1: error %v; want incomplete input", err)
+	}
+}
+
+func TestCycle(t *testing.T) {
+	checkError(t, []errorTest{
+		{"a = a + 1", CycleError},
+		{"a = b + 1; b = a", CycleError},
+		{"a = b; b = c; c = a", CycleError},
+	})
+	// エラーになった代入はなかったことになります。
+	env := NewEnv()
+	run(env, "a = 1; b = a + 1")
+	if _, err := run(env, "a = b"); errorKind(err) != CycleError {
+		t.Errorf("a = b: error %v; want cycle", err)
+	}
+	if out, err := run(env, "b"); err != nil || out != "2" {
+		t.Errorf("b = %q, %v; want \"2\"", out, err)
+	}
+}
+
+func TestEagerAssign(t *testing.T) {
+	checkEval(t, []evalTest{
+		// := は値を代入するので循環しません。
+		{"a := 1; a := a + 1; a", "2"},
+		{"x = 1; y := x + 1; x = 5; y", "2"},
+		{"x = 1; y = x + 1; x = 5; y", "6"},
+		{"x := 1; varkind(x)", "value"},
+		{"x = 1; varkind(x)", "formula"},
+		{"varkind(x)", "undefined"},
+	})
+	checkError(t, []errorTest{
+		{"1 := 2", SyntaxError},
+	})
+}
+
+func TestOnChange(t *testing.T) {
+	env := NewEnv()
+	var changes []string
+	OnChange(env, func(name string, before, after Ast) {
+		changes = append(changes, fmt.Sprintf("%s: %v -> %v",
+			name, before, after))
+	})
+	for _, in := range []string{
+		"y = 1",
+		"x = y + 1",
+		"z = x * 2",
+		"y = 5",
+		"y = 5", // 値がかわらなければ知らせません。
+		"x := 0",
+	} {
+		if _, err := run(env, in); err != nil {
+			t.Fatalf("%q: %s", in, err)
+		}
+	}
+	want := []string{
+		"y: <nil> -> 1",
+		"x: <nil> -> 2",
+		"z: <nil> -> 4",
+		"y: 1 -> 5",
+		"x: 2 -> 6",
+		"z: 4 -> 12",
+		"x: 6 -> 0",
+		"z: 12 -> 0",
+	}
+	if strings.Join(changes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("changes:\n%s\nwant:\n%s", strings.Join(changes, "\n"),
+			strings.Join(want, "\n"))
+	}
+	// 関数を定義しなおしたときも、関数の本体で使っている変数を
+	// かえたときも知らせます。
+	changes = nil
+	for _, in := range []string{
+		"rate = 2",
+		"g(n) = n * rate",
+		"w = g(3)",
+		"g(n) = n * 100",
+		"g(n) = n * rate",
+		"rate = 10",
+		"g = undef",
+	} {
+		if _, err := run(env, in); err != nil {
+			t.Fatalf("%q: %s", in, err)
+		}
+	}
+	want = []string{
+		"rate: <nil> -> 2",
+		"w: <nil> -> 6",
+		"w: 6 -> 300",
+		"w: 300 -> 6",
+		"rate: 2 -> 10",
+		"w: 6 -> 30",
+		"w: 30 -> name error: no such function: g",
+	}
+	if strings.Join(changes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("changes:\n%s\nwant:\n%s", strings.Join(changes, "\n"),
+			strings.Join(want, "\n"))
+	}
+	// 評価がエラーになるときはErrorValueを知らせます。
+	changes = nil
+	for _, in := range []string{
+		"d = 1",
+		"q = 1 / d",
+		"d = 0",
+		"d = 2",
+	} {
+		if _, err := run(env, in); err != nil {
+			t.Fatalf("%q: %s", in, err)
+		}
+	}
+	want = []string{
+		"d: <nil> -> 1",
+		"q: <nil> -> 1",
+		"d: 1 -> 0",
+		"q: 1 -> division error: division by zero: (1 / d)",
+		"d: 0 -> 2",
+		"q: division error: division by zero: (1 / d) -> 1/2",
+	}
+	if strings.Join(changes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("changes:\n%s\nwant:\n%s", strings.Join(changes, "\n"),
+			strings.Join(want, "\n"))
+	}
+	// 代入する前の値は前に知らせた値を使うので、式は代入するたびに
+	// 1回だけ評価します。
+	env = NewEnv()
+	count := 0
+	SetFuncN(env, "count", func(_ []Ast, _ *Env) Ast {
+		count++
+		return Num(count)
+	})
+	OnChange(env, func(string, Ast, Ast) {})
+	if _, err := run(env, "c = count() + y"); err != nil {
+		t.Fatal(err)
+	}
+	count = 0
+	for _, in := range []string{"y = 1", "y = 2"} {
+		if _, err := run(env, in); err != nil {
+			t.Fatalf("%q: %s", in, err)
+		}
+	}
+	if count != 2 {
+		t.Errorf("count() called %d times, want 2", count)
+	}
+	checkEval(t, []evalTest{
+		{"x = y + z; deps(x)", "[y, z]"},
+		{"g(n) = n * rate; x = g(3) + y; deps(x)", "[rate, y]"},
+		{"g(n) = n * rate; h(n) = g(n) + 1; x = h(1); deps(x)", "[rate]"},
+		{"g(n) = n * rate; h(n) = g(n) + 1; x = h(1); dependents(g)", "[x]"},
+		{"fact(n) = n <= 1 ? 1 : n * fact(n - 1); x = fact(k); deps(x)", "[k]"},
+		{"g(n) = n * rate; x = g(3); dependents(g)", "[x]"},
+		{"x = let y = 1 in y + z; deps(x)", "[z]"},
+		{"x = y + 1; w = y * 2; dependents(y)", "[w, x]"},
+		{"x = y + 1; x := 2; dependents(y)", "[]"},
+	})
+}
+
+func TestCompoundAssign(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"x = 1; x += 2; x *= 3; x", "9"},
+		{"x = 1; x++; x++; x", "3"},
+		{"x = 1; x--; x", "0"},
+		{"x = 3; x **= 2; x", "9"},
+		{"x = 5; x <<= 1; x", "10"},
+		{"x = 1; x += x; x", "2"},
+		// 式なら式のままなので、yをかえるとxもかわります。
+		{"x = y + 1; x += 1; y = 2; x", "4"},
+		{"x = y + 1; x += 1; varkind(x)", "formula"},
+		{"x := 1; x += 1; varkind(x)", "value"},
+		// 関数を使う式も、関数を定義しなおすとかわります。
+		{"g(n) = n*2; x = g(1); x += 1; g(n) = n*10; x", "11"},
+	})
+	checkError(t, []errorTest{
+		{"undefined += 1", NameError},
+		{"1 += 1", SyntaxError},
+	})
+}
+
+func TestScript(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"1 + 2; 3 * 4", "12"},
+		{"1;;2", "2"},
+		{"x = 1\ny = x + 1\n\ny * 10", "20"},
+	})
+	stmts, err := TryReadAll([]byte("a = 1; b = 2\n\na + b;"))
+	if err != nil || len(stmts) != 3 {
+		t.Fatalf("TryReadAll() = %v, %v; want 3 statements", stmts, err)
+	}
+	vs, err := TryEvalAll(stmts, NewEnv())
+	if err != nil || len(vs) != 3 || vs[2].String() != "3" {
+		t.Errorf("TryEvalAll() = %v, %v; want [1 2 3]", vs, err)
+	}
+	// エラーになった文の前までの結果はかえします。
+	stmts, _ = TryReadAll([]byte("1; nosuch(2); 3"))
+	if vs, err = TryEvalAll(stmts, NewEnv()); err == nil || len(vs) != 1 {
+		t.Errorf("TryEvalAll() = %v, %v; want [1] and an error", vs, err)
+	}
+	checkError(t, []errorTest{
+		{"1 + ; 2", SyntaxError},
+		{"1 2", SyntaxError},
+	})
+}
+
+func TestComments(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"1 + 2 # comment", "3"},
+		{"1 + /* comment */ 2", "3"},
+		{"1 + # comment\n2", "3"},
+		{"x = 1 # x\ny = 2 /* y */; x + y", "3"},
+	})
+	if _, err := TryReadAll([]byte("1 + /* comment")); !IsIncomplete(err) {
+		t.Errorf("unterminated comment: error %v; want incomplete input", err)
+	}
+	// TriviaとTextをつなげると、コメントもふくめて入力にもどります。
+	in := "x = 1 + 2 # c\n/* a */ f(\"s\") ; 3 "
+	toks := Tokens([]byte(in))
+	if got := JoinTokens(toks); got != in {
+		t.Errorf("JoinTokens() = %q; want %q", got, in)
+	}
+	for _, tok := range toks {
+		if tok.Kind == TokNewline && tok.Trivia != " # c" {
+			t.Errorf("newline trivia = %q; want \" # c\"", tok.Trivia)
+		}
+		if tok.Text == "f" && tok.Trivia != "/* a */ " {
+			t.Errorf("f trivia = %q; want \"/* a */ \"", tok.Trivia)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	checkEval(t, []evalTest{
+		{`"abc"`, "abc"},
+		{`"a\tb"`, "a\tb"},
+		{`"a" + "b"`, "ab"},
+		{`"日本" + "語"`, "日本語"},
+		{`"abc" < "abd"`, "true"},
+		{`"a" == "a"`, "true"},
+		{`len("日本語")`, "3"},
+		{"len([1, 2])", "2"},
+		{`substr("godentaku", 2, 4)`, "dent"},
+		{`substr("godentaku", 2)`, "dentaku"},
+		{`upper("abc")`, "ABC"},
+		{`lower("ABC")`, "abc"},
+		{`format("%s: %5.1f%%", "rate", 12.345)`, "rate:  12.3%"},
+		{`format("%d", 2**70)`, "1180591620717411303424"},
+		{`format("%v", true)`, "true"},
+		{"len(s)", "len(s)"},
+	})
+	checkError(t, []errorTest{
+		{`"a" + 1`, TypeError},
+		{`-"a"`, TypeError},
+		{"len(1)", TypeError},
+		{`substr("abc", 5)`, ValueError},
+		{`"abc`, SyntaxError},
+	})
+}
@@ -0,0 +1,245 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"bytes"
+	"fmt"
+	"utf8"
+)
+
+// トークンの種類です。
+type TokenKind int
+
+const (
+	TokEOF       TokenKind = iota // 入力の終わり
+	TokNewline                    // '\n'
+	TokNum                        // 123, 0x1f, 3.14, 255u8 など
+	TokIdent                      // abc, .printBase など
+	TokOp                         // + - * / = == < && ! など
+	TokLParen                     // '('
+	TokRParen                     // ')'
+	TokComma                      // ','
+	TokLBracket                   // '['
+	TokRBracket                   // ']'
+	TokSemicolon                  // ';'
+	TokString                     // "abc" など
+	TokIllegal                    // 知らない文字
+)
+
+var tokenKindNames = []string{
+	TokEOF:       "EOF",
+	TokNewline:   "newline",
+	TokNum:       "number",
+	TokIdent:     "identifier",
+	TokOp:        "operator",
+	TokLParen:    "(",
+	TokRParen:    ")",
+	TokComma:     ",",
+	TokLBracket:  "[",
+	TokRBracket:  "]",
+	TokSemicolon: ";",
+	TokString:    "string",
+	TokIllegal:   "illegal",
+}
+
+func (k TokenKind) String() string {
+	if int(k) < len(tokenKindNames) {
+		return tokenKindNames[k]
+	}
+	return fmt.Sprintf("token(%d)", int(k))
+}
+
+// 演算子です。<< と < のように先頭がおなじものは長いほうを先に
+// 書いておきます。
+var operators = []string{
+	"**=", "<<=", ">>=", "&^=",
+	"+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=",
+	"**", "<<", ">>", "->", "&^", "&&", "||", "==", "!=", "<=", ">=", ":=",
+	"+", "-", "*", "/", "%", "=", "&", "|", "^", "~", "!", "<", ">",
+	"?", ":",
+}
+
+// bufの先頭の演算子の長さをかえします。演算子でなければ0です。
+func opLen(buf []byte) int {
+	for _, op := range operators {
+		if len(buf) >= len(op) && string(buf[:len(op)]) == op {
+			return len(op)
+		}
+	}
+	return 0
+}
+
+// 字句解析でとりだしたトークンです。
+// Textは入力のその部分をそのままもっています。
+// Triviaはトークンの前にある空白やコメントです。式の意味にはかかわり
+// ませんが、入力を整形するときにコメントを残せるようにとっておきます。
+type Token struct {
+	Kind   TokenKind
+	Text   string
+	Trivia string
+	Pos    Pos
+}
+
+func (t Token) String() string {
+	return fmt.Sprintf("%s %s %q", t.Pos, t.Kind, t.Text)
+}
+
+// 入力をトークンに分割する字句解析器です。
+// パーザのほか、シンタックスハイライトや補完などにも使えます。
+// 空白と # や /* */ のコメントは、次のトークンのTriviaになります。
+type Lexer struct {
+	src       *source
+	buf       []byte // まだ読んでいない入力
+	line, col int    // bufの先頭の行と桁
+}
+
+// bを読むLexerを作ります。
+func NewLexer(b []byte) *Lexer {
+	return &Lexer{src: &source{text: b}, buf: b, line: 1, col: 1}
+}
+
+// bufの先頭のオフセットをかえします。
+func (l *Lexer) offset() int {
+	return len(l.src.text) - len(l.buf)
+}
+
+// nバイト読みすすめて、行と桁を数えます。
+func (l *Lexer) advance(n int) {
+	for _, c := range l.buf[:n] {
+		switch {
+		case c == '\n':
+			l.line++
+			l.col = 1
+		case utf8.RuneStart(c):
+			l.col++
+		}
+	}
+	l.buf = l.buf[n:]
+}
+
+// 次のトークンを読みます。
+// 入力の最後まで読んだら、あとはずっとTokEOFをかえします。
+func (l *Lexer) Next() Token {
+	n, ok := triviaLen(l.buf)
+	if !ok {
+		// /* のあとに */ がないまま入力が終わっています。
+		// 続きの行に */ があるかもしれません。
+		pos := Pos{Start: l.offset(), End: l.offset() + n,
+			Line: l.line, Col: l.col, src: l.src}
+		panic(newError(IncompleteError, pos, "unterminated comment", ""))
+	}
+	trivia := string(l.buf[:n])
+	l.advance(n)
+	pos := Pos{Start: l.offset(), Line: l.line, Col: l.col, src: l.src}
+	var kind TokenKind
+	n = 0 // トークンのバイト数
+	switch c := peek(l.buf); {
+	case len(l.buf) == 0:
+		kind = TokEOF
+	case c == '\n':
+		kind, n = TokNewline, 1
+	case isDigit(c) || (c == '.' && len(l.buf) > 1 && isDigit(l.buf[1])):
+		// 1e99999999999 のように読めない数値は、このトークンの
+		// 位置のエラーにします。Fragは数値の文字列です。
+		defer func() {
+			if x := recover(); x != nil {
+				if err, ok := x.(*Error); ok && !err.Pos.IsValid() {
+					err.Pos = pos
+					err.Pos.End = pos.Start + len(err.Frag)
+				}
+				panic(x)
+			}
+		}()
+		_, rest := getNumber(l.buf)
+		rest = rest[fixedSuffix(rest):]
+		kind, n = TokNum, len(l.buf)-len(rest)
+	case isAlpha(c) || c == '.':
+		_, rest := getSymbol(l.buf)
+		kind, n = TokIdent, len(l.buf)-len(rest)
+	case opLen(l.buf) > 0:
+		kind, n = TokOp, opLen(l.buf)
+	case c == '(':
+		kind, n = TokLParen, 1
+	case c == ')':
+		kind, n = TokRParen, 1
+	case c == ',':
+		kind, n = TokComma, 1
+	case c == '[':
+		kind, n = TokLBracket, 1
+	case c == ']':
+		kind, n = TokRBracket, 1
+	case c == ';':
+		kind, n = TokSemicolon, 1
+	case c == '"':
+		var ok bool
+		if n, ok = stringLen(l.buf); !ok {
+			pos.End = pos.Start + n
+			panic(newError(SyntaxError, pos, "unterminated string",
+				string(l.buf[:n])))
+		}
+		kind = TokString
+	default:
+		// UTF-8の文字の途中で切らないように1文字分すすめます。
+		_, n = utf8.DecodeRune(l.buf)
+		kind = TokIllegal
+	}
+	text := string(l.buf[:n])
+	l.advance(n)
+	pos.End = l.offset()
+	return Token{Kind: kind, Text: text, Trivia: trivia, Pos: pos}
+}
+
+// bufの先頭の空白とコメントのバイト数をかえします。
+// # から行末までと、/* から */ までがコメントです。改行は文の区切り
+// なのでふくみませんが、/* */ の中の改行はコメントの一部です。
+// */ がなければokはfalseです。
+func triviaLen(buf []byte) (n int, ok bool) {
+	n = len(buf) - len(skipSpace(buf))
+	for n < len(buf) && (buf[n] == '#' || bytes.HasPrefix(buf[n:], []byte("/*"))) {
+		rest := buf[n:]
+		if rest[0] == '#' {
+			if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+				n += i
+			} else {
+				n = len(buf)
+			}
+		} else {
+			i := bytes.Index(rest[2:], []byte("*/"))
+			if i < 0 {
+				return len(buf), false
+			}
+			n += 2 + i + 2
+		}
+		n = len(buf) - len(skipSpace(buf[n:]))
+	}
+	return n, true
+}
+
+// bを最後まで読んでトークンのsliceにします。最後はTokEOFです。
+// 閉じていないコメントがあるとIncompleteErrorの*Errorでpanicします。
+func Tokens(b []byte) []Token {
+	l := NewLexer(b)
+	var toks []Token
+	for {
+		tok := l.Next()
+		toks = append(toks, tok)
+		if tok.Kind == TokEOF {
+			break
+		}
+	}
+	return toks
+}
+
+// トークンのsliceを入力の文字列にもどします。
+// TriviaとTextをつなげるので、Tokens(b)をもどすとコメントもふくめて
+// bとおなじになります。
+func JoinTokens(toks []Token) string {
+	var b bytes.Buffer
+	for _, tok := range toks {
+		b.WriteString(tok.Trivia)
+		b.WriteString(tok.Text)
+	}
+	return b.String()
+}
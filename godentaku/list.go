@@ -0,0 +1,130 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"strings"
+)
+
+// リストをAstインターフェイスをみたすList型として定義します。
+// [1, 2, 3] のように書きます。評価すると要素を評価したListになります。
+type List []Ast
+
+func (l List) String() string {
+	elems := make([]string, len(l))
+	for i, v := range l {
+		elems[i] = v.String()
+	}
+	return "[" + strings.Join(elems, ", ") + "]"
+}
+func (l List) Eval(env *Env) Ast {
+	v := make(List, len(l))
+	for i, e := range l {
+		v[i] = e.Eval(env)
+	}
+	return v
+}
+
+// 関数とリストをうけとる関数の、最初の2つの引数を評価します。
+// 2つめが未定義のSymbolをふくむときは、関数呼出のまま評価を先送りに
+// するので、deferredにそのAstをかえします。
+func listArgs(name string, args []Ast, env *Env) (f Ast, list List, deferred Ast) {
+	f = args[0].Eval(env)
+	v := args[1].Eval(env)
+	if list, ok := v.(List); ok {
+		return f, list, nil
+	}
+	if isValue(v) {
+		panic(newError(TypeError, PosOf(args[1]), "not list", v.String()))
+	}
+	return f, nil, deferCall(name, append([]Ast{f, v}, args[2:]...)...)
+}
+
+// map(f, list): listの要素それぞれにfを呼んだ結果のリスト
+//  map(x -> x * 2, [1, 2, 3]) = [2, 4, 6]
+func mapFunc(args []Ast, env *Env) Ast {
+	checkArgs("map", args, 2, 2)
+	f, list, deferred := listArgs("map", args, env)
+	if deferred != nil {
+		return deferred
+	}
+	r := make(List, len(list))
+	for i, v := range list {
+		r[i] = callValue(f, []Ast{v}, env)
+	}
+	return r
+}
+
+// filter(f, list): listの要素のうちfがtrueになるもののリスト
+//  filter(x -> x % 2 == 0, [1, 2, 3, 4]) = [2, 4]
+func filterFunc(args []Ast, env *Env) Ast {
+	checkArgs("filter", args, 2, 2)
+	f, list, deferred := listArgs("filter", args, env)
+	if deferred != nil {
+		return deferred
+	}
+	r := List{}
+	for _, v := range list {
+		b, ok := callValue(f, []Ast{v}, env).(Bool)
+		if !ok {
+			panic(newError(TypeError, PosOf(args[0]),
+				"filter: non-boolean result", f.String()))
+		}
+		if b {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+// reduce(f, list, init): initとlistの要素を左から順にfでまとめます。
+// initを省略すると最初の要素からはじめます。
+//  reduce((a, b) -> a + b, [1, 2, 3], 0) = 6
+func reduceFunc(args []Ast, env *Env) Ast {
+	checkArgs("reduce", args, 2, 3)
+	f, list, deferred := listArgs("reduce", args, env)
+	if deferred != nil {
+		return deferred
+	}
+	var acc Ast
+	if len(args) == 3 {
+		acc = args[2].Eval(env)
+	} else {
+		if len(list) == 0 {
+			panic(newError(ValueError, PosOf(args[1]),
+				"reduce of empty list with no initial value", ""))
+		}
+		acc, list = list[0], list[1:]
+	}
+	for _, v := range list {
+		acc = callValue(f, []Ast{acc, v}, env)
+	}
+	return acc
+}
+
+// apply(f, list): listの要素を引数にしてfを呼びます。
+//  apply(max, [3, 1, 2]) = 3
+func applyFunc(args []Ast, env *Env) Ast {
+	checkArgs("apply", args, 2, 2)
+	f, list, deferred := listArgs("apply", args, env)
+	if deferred != nil {
+		return deferred
+	}
+	return callValue(f, list, env)
+}
+
+// Listの要素をPrint()で文字列にします。
+func printList(l List, env *Env) string {
+	elems := make([]string, len(l))
+	for i, v := range l {
+		// リストの中の文字列はクオートして、区切りとまぎれないように
+		// します。
+		if s, ok := v.(String); ok {
+			elems[i] = s.String()
+		} else {
+			elems[i] = Print(v, env)
+		}
+	}
+	return "[" + strings.Join(elems, ", ") + "]"
+}
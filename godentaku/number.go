@@ -0,0 +1,236 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"big"
+	"fmt"
+)
+
+// intの最大値と最小値です。
+// intが32bitか64bitかは環境によってちがうので^uint(0)から計算します。
+const (
+	maxInt = int(^uint(0) >> 1)
+	minInt = -maxInt - 1
+)
+
+// 任意精度の整数をAstインターフェイスをみたすBigNum型として定義します。
+// intにおさまらない数値はこの型になります。
+// *big.Intを埋め込んでいるので、String()などのbig.Intのメソッドを
+// そのまま呼びだせます。
+type BigNum struct {
+	*big.Int
+}
+
+func (n BigNum) Eval(_ *Env) Ast {
+	return n
+}
+
+// 数値の型の順位です。
+// 2つの数値を計算するときは順位の高いほうの型にそろえてから計算します。
+const (
+	notNumber = iota
+	intRank   // Num
+	bigRank   // BigNum
+	ratRank   // Rational
+	decRank   // Decimal
+	floatRank // Float
+	cmplxRank // Complex
+	fixedRank // Fixed (ほかの型とはまぜないので順位はありません)
+)
+
+func numRank(v Ast) int {
+	switch v.(type) {
+	case Num:
+		return intRank
+	case BigNum:
+		return bigRank
+	case Rational:
+		return ratRank
+	case Decimal:
+		return decRank
+	case Float:
+		return floatRank
+	case Complex:
+		return cmplxRank
+	case Fixed:
+		return fixedRank
+	}
+	return notNumber
+}
+
+// vが数値かどうか。
+func isNumber(v Ast) bool {
+	return numRank(v) != notNumber
+}
+
+// vが値かどうか。値はこれ以上評価してもかわらないもので、未定義の
+// SymbolやそれをふくむBinOpなどは値ではありません。
+func isValue(v Ast) bool {
+	switch v.(type) {
+	case Bool, String, List, Closure:
+		return true
+	}
+	return isNumber(v)
+}
+
+// vが整数かどうか。
+func isInteger(v Ast) bool {
+	rank := numRank(v)
+	return rank == intRank || rank == bigRank
+}
+
+// 整数を*big.Intにします。
+func toBig(v Ast) *big.Int {
+	switch n := v.(type) {
+	case Num:
+		return big.NewInt(int64(n))
+	case BigNum:
+		return n.Int
+	case Fixed:
+		return n.Int()
+	}
+	panic(newError(TypeError, PosOf(v), "not integer", v.String()))
+}
+
+// intにおさまるならNumに、おさまらなければBigNumにします。
+// 計算結果はいつもこれを通すので、同じ値はいつも同じ型になります。
+func intResult(x *big.Int) Ast {
+	if x.Cmp(big.NewInt(int64(minInt))) >= 0 &&
+		x.Cmp(big.NewInt(int64(maxInt))) <= 0 {
+		return Num(x.Int64())
+	}
+	return BigNum{x}
+}
+
+// 数値l, rにe.Opを計算した結果をかえします。
+// あまり % はGoとおなじように a - b*truncate(a/b) で、結果の符号は
+// 割られる数とおなじです。あまりをいつも0以上にしたいときはmod()を
+// 使います。
+// Decimalの丸めなどはenvの設定にしたがいます。
+func calc(e BinOp, l, r Ast, env *Env) Ast {
+	if isCompareOp(e.Op) {
+		return compare(e, l, r, env)
+	}
+	if isBitOp(e.Op) {
+		return bitCalc(e, l, r, env)
+	}
+	if e.Op == "**" {
+		return powCalc(e, l, r, env)
+	}
+	// Fixedは型の幅で計算するので、ほかの数値とは別にあつかいます。
+	if numRank(l) == fixedRank || numRank(r) == fixedRank {
+		return fixedCalc(e, l, r, env)
+	}
+	rank := numRank(l)
+	if numRank(r) > rank {
+		rank = numRank(r)
+	}
+	// 整数どうしの割り算は分数で計算して、割り切れなければRationalに
+	// します。.decimalが設定されていればDecimalで計算します。
+	if e.Op == "/" && rank < ratRank {
+		rank = ratRank
+		if Defined(env, ".decimal") {
+			rank = decRank
+		}
+	}
+	switch rank {
+	case intRank:
+		if n, ok := intCalc(e, int(l.(Num)), int(r.(Num))); ok {
+			return Num(n)
+		}
+		// intであふれたらbig.Intで計算しなおします。
+		return intResult(bigCalc(e, toBig(l), toBig(r)))
+	case bigRank:
+		return intResult(bigCalc(e, toBig(l), toBig(r)))
+	case ratRank:
+		return ratResult(ratCalc(e, toRat(l), toRat(r)))
+	case decRank:
+		return decCalc(e, toDecimal(l, env), toDecimal(r, env), env)
+	case floatRank:
+		return Float(floatCalc(e, toFloat(l), toFloat(r)))
+	case cmplxRank:
+		return Complex(complexCalc(e, toComplex(l), toComplex(r)))
+	}
+	panic(newError(TypeError, e.Pos, "not number", e.String()))
+}
+
+// intのまま計算します。
+// 結果がintであふれるときはokがfalseになります。
+func intCalc(e BinOp, a, b int) (n int, ok bool) {
+	switch e.Op {
+	case "+":
+		n = a + b
+		return n, (n > a) == (b > 0)
+	case "-":
+		n = a - b
+		return n, (n < a) == (b > 0)
+	case "*":
+		if a == 0 || b == 0 {
+			return 0, true
+		}
+		n = a * b
+		return n, n/b == a && !(a == -1 && b == minInt) &&
+			!(b == -1 && a == minInt)
+	case "%":
+		// 0で割ったときのエラーはbigCalc()にまかせます。
+		if b == 0 {
+			return 0, false
+		}
+		return a % b, true
+	}
+	panic(newError(TypeError, e.Pos,
+		fmt.Sprintf("unsupported binOp:%s", e.Op), e.String()))
+}
+
+// big.Intで計算します。
+// 引数の*big.Intは他の値と共有しているかもしれないので、結果は新しく
+// 作ったbig.Intにいれます。
+func bigCalc(e BinOp, a, b *big.Int) *big.Int {
+	z := new(big.Int)
+	switch e.Op {
+	case "+":
+		return z.Add(a, b)
+	case "-":
+		return z.Sub(a, b)
+	case "*":
+		return z.Mul(a, b)
+	case "%":
+		if b.Sign() == 0 {
+			panic(newError(DivisionError, e.Pos,
+				"division by zero", e.String()))
+		}
+		// Remは0の方向に切り捨てた商のあまりなので、符号は割られる数と
+		// おなじになります。
+		return z.Rem(a, b)
+	}
+	panic(newError(TypeError, e.Pos,
+		fmt.Sprintf("unsupported binOp:%s", e.Op), e.String()))
+}
+
+// 数値vの符号を反転します。
+// Fixedがあふれるときはenvの.overflowの設定にしたがいます。
+func negate(e UnaryOp, v Ast, env *Env) Ast {
+	switch n := v.(type) {
+	case Num:
+		if int(n) == minInt {
+			return intResult(new(big.Int).Neg(toBig(n)))
+		}
+		return Num(-int(n))
+	case BigNum:
+		return intResult(new(big.Int).Neg(n.Int))
+	case Rational:
+		return Rational{new(big.Rat).Neg(n.Rat)}
+	case Decimal:
+		return Decimal{new(big.Int).Neg(n.Unscaled), n.Scale}
+	case Float:
+		return Float(-float64(n))
+	case Complex:
+		return Complex(-complex128(n))
+	case Fixed:
+		x := new(big.Int).Neg(n.Int())
+		return toFixed(n.Type, x, e.Pos, e.String(), env)
+	}
+	panic(newError(TypeError, e.Pos, "not number", e.String()))
+}
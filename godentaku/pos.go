@@ -0,0 +1,135 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"utf8"
+)
+
+// 入力のどこから読んだかをあらわします。
+// Start, Endは入力の先頭からのバイトオフセットで、[Start, End)の範囲です。
+// Line, ColはStartの行と桁で、どちらも1から数えます。
+// Lineが0のものは位置がわからないことをあらわします。
+type Pos struct {
+	Start, End int
+	Line, Col  int
+	src        *source
+}
+
+// 読みこんだ入力です。
+// Posからポインタで参照しておくと、後で別の行を読んだあとでも
+// その式がもともとどういう入力だったかを表示できます。
+type source struct {
+	text []byte
+}
+
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Pos) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// 入力のStartからEndまでの部分をかえします。
+func (p Pos) Text() string {
+	if p.src == nil {
+		return ""
+	}
+	return string(p.src.text[p.Start:p.End])
+}
+
+// Startを含む行の内容と、その行の先頭のオフセットをかえします。
+func (p Pos) line() (line []byte, offset int) {
+	if p.src == nil {
+		return nil, 0
+	}
+	text := p.src.text
+	start := bytes.LastIndex(text[:p.Start], []byte{'\n'}) + 1
+	end := bytes.IndexByte(text[start:], '\n')
+	if end < 0 {
+		return text[start:], start
+	}
+	return text[start : start+end], start
+}
+
+// 位置情報をもっているAstです。
+// パーザが作るUnaryOp, BinOp, AssignOp, FunCall, Atomはこれをみたします。
+type Node interface {
+	Ast
+	Position() Pos
+}
+
+// 入力中にあらわれた数値やSymbolです。
+// NumやSymbolは評価した結果の値としても使うので、それ自体には位置情報を
+// もたせずに、パーザが読んだものはAtomでつつんで位置を覚えておきます。
+type Atom struct {
+	Value Ast
+	Pos   Pos
+}
+
+func (a Atom) String() string {
+	return a.Value.String()
+}
+func (a Atom) Eval(env *Env) Ast {
+	return a.Value.Eval(env)
+}
+func (a Atom) Position() Pos {
+	return a.Pos
+}
+
+// AtomでつつまれていたらとりだしたAstをかえします。
+func bare(a Ast) Ast {
+	if atom, ok := a.(Atom); ok {
+		return atom.Value
+	}
+	return a
+}
+
+// Astの位置情報をかえします。わからなければ無効なPosになります。
+func PosOf(a Ast) Pos {
+	if n, ok := a.(Node); ok {
+		return n.Position()
+	}
+	return Pos{}
+}
+
+// エラーを表示用の文字列にします。
+// 位置情報のある*Errorなら、その行を表示して問題の部分の下に ^~~~ を
+// つけます。
+//  1:5: syntax error: unbalanced paren: (1+2
+//  1 + (1+2
+//      ^~~~
+func Diagnose(err os.Error) string {
+	e, ok := err.(*Error)
+	if !ok || !e.Pos.IsValid() || e.Pos.src == nil {
+		return fmt.Sprint(err)
+	}
+	line, offset := e.Pos.line()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s: %s\n%s\n", e.Pos, e, line)
+	// タブはそのまま残して、桁がずれないようにします。
+	for _, c := range line[:e.Pos.Start-offset] {
+		if c == '\t' {
+			b.WriteByte('\t')
+		} else if utf8.RuneStart(c) {
+			b.WriteByte(' ')
+		}
+	}
+	b.WriteByte('^')
+	end := e.Pos.End - offset
+	if end > len(line) {
+		end = len(line)
+	}
+	for n := utf8.RuneCount(line[e.Pos.Start-offset : end]); n > 1; n-- {
+		b.WriteByte('~')
+	}
+	return b.String()
+}
@@ -0,0 +1,174 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"big"
+	"cmath"
+	"math"
+)
+
+// 結果の絶対値が2**maxBitsより大きくなる計算はしません。
+// メモリが足りなくなるほど大きな数を作ろうとすると、recover()でも
+// とめられずにプログラムが終了してしまうからです。
+const maxBits = 1 << 22
+
+// 絶対値がbase以上の数をn乗すると、2**maxBitsより大きくなるならValueError
+// にします。0, 1, -1は何乗しても大きくなりません。
+func checkPowSize(e BinOp, base, n *big.Int) {
+	// |base| >= 2**(BitLen-1) なので、結果は2**((BitLen-1)*n)以上です。
+	bits := new(big.Int).Mul(big.NewInt(int64(base.BitLen()-1)), n)
+	if bits.Cmp(big.NewInt(maxBits)) > 0 {
+		panic(newError(ValueError, e.Pos, "result too large", e.String()))
+	}
+}
+
+// 数値l, rのべき乗 l ** r を計算します。
+// 指数が整数なら、整数や分数や小数(Decimal)は誤差なしに計算します。
+//  2**10 = 1024  2**-2 = 1/4  (2/3)**2 = 4/9
+// 指数が整数でなければFloatで、どちらかが複素数ならComplexで計算します。
+func powCalc(e BinOp, l, r Ast, env *Env) Ast {
+	if isInteger(r) || numRank(r) == fixedRank {
+		if v, ok := intPow(e, l, toBig(r), env); ok {
+			return v
+		}
+	}
+	switch {
+	case numRank(l) == fixedRank:
+		panic(newError(TypeError, e.Pos,
+			"non-integer exponent for "+l.(Fixed).Type.String(),
+			e.String()))
+	case numRank(l) == cmplxRank || numRank(r) == cmplxRank:
+		return Complex(cmath.Pow(toComplex(l), toComplex(r)))
+	}
+	// 負の数の整数でない指数はNaNになります。
+	return Float(math.Pow(toFloat(l), toFloat(r)))
+}
+
+// 整数の指数nでべき乗を計算します。
+// FloatとComplexはokがfalseになるので、呼出元で計算します。
+func intPow(e BinOp, l Ast, n *big.Int, env *Env) (v Ast, ok bool) {
+	if numRank(l) >= floatRank && numRank(l) != fixedRank {
+		return nil, false
+	}
+	// 大きすぎる指数で計算がおわらなくならないようにします。
+	if _, ok := intResult(n).(Num); !ok {
+		panic(newError(ValueError, e.Pos, "exponent too large", e.String()))
+	}
+	neg := n.Sign() < 0
+	n = new(big.Int).Abs(n)
+	if neg && sign(l) == 0 {
+		panic(newError(DivisionError, e.Pos, "division by zero", e.String()))
+	}
+	switch b := l.(type) {
+	case Fixed:
+		if neg {
+			panic(newError(ValueError, e.Pos,
+				"negative exponent for "+b.Type.String(), e.String()))
+		}
+		a := b.Int()
+		if overflowMode(env) == "wrap" {
+			// 下位bitだけのこすので、2**Bitsで割ったあまりだけ
+			// 計算すれば十分です。
+			m := new(big.Int).Lsh(big.NewInt(1), b.Type.Bits)
+			x := new(big.Int).Exp(a, n, m)
+			return Fixed{b.Type, wrapBits(b.Type, x)}, true
+		}
+		if a.BitLen() > 1 && n.Cmp(big.NewInt(int64(b.Type.Bits))) > 0 {
+			// |a| >= 2 でBitsより大きく累乗すると、かならず型に
+			// おさまりません。計算はせずに、おなじ符号の型の外の
+			// 値を.overflowにしたがって型におさめます。
+			x := new(big.Int).Lsh(big.NewInt(1), b.Type.Bits)
+			if a.Sign() < 0 && n.Bit(0) == 1 {
+				x.Neg(x)
+			}
+			return toFixed(b.Type, x, e.Pos, e.String(), env), true
+		}
+		x := new(big.Int).Exp(a, n, nil)
+		return toFixed(b.Type, x, e.Pos, e.String(), env), true
+	case Num, BigNum:
+		checkPowSize(e, toBig(b), n)
+		x := new(big.Int).Exp(toBig(b), n, nil)
+		if !neg {
+			return intResult(x), true
+		}
+		// 負の指数は割り算とおなじように分数かDecimalになります。
+		if Defined(env, ".decimal") {
+			return decPow(e, Decimal{toBig(b), 0}, n, neg, env), true
+		}
+		return ratResult(new(big.Rat).SetFrac(big.NewInt(1), x)), true
+	case Rational:
+		checkPowSize(e, b.Num(), n)
+		checkPowSize(e, b.Denom(), n)
+		num := new(big.Int).Exp(b.Num(), n, nil)
+		den := new(big.Int).Exp(b.Denom(), n, nil)
+		if neg {
+			num, den = den, num
+		}
+		return ratResult(new(big.Rat).SetFrac(num, den)), true
+	case Decimal:
+		return decPow(e, b, n, neg, env), true
+	}
+	return nil, false
+}
+
+// Decimalのべき乗です。負の指数は 1 / d**n を計算します。
+// 小数点以下が.decimalScale桁より長くなったときは丸めます。
+func decPow(e BinOp, d Decimal, n *big.Int, neg bool, env *Env) Decimal {
+	checkPowSize(e, d.Unscaled, n)
+	// 小数点の位置もDecimal.Scale * n になるので、大きすぎないか
+	// 先に調べます。intの掛け算があふれないようにbig.Intで計算します。
+	scale := new(big.Int).Mul(big.NewInt(int64(d.Scale)), n)
+	if new(big.Int).Abs(scale).Cmp(big.NewInt(maxBits)) > 0 {
+		panic(newError(ValueError, e.Pos, "result too large", e.String()))
+	}
+	z := Decimal{new(big.Int).Exp(d.Unscaled, n, nil), int(scale.Int64())}
+	if neg {
+		return decCalc(BinOp{Op: "/", Left: Num(1), Right: z, Pos: e.Pos},
+			Decimal{big.NewInt(1), 0}, z, env)
+	}
+	if scale := decimalScale(env); z.Scale > scale {
+		z = rescale(z, scale, roundingMode(env))
+	}
+	return z
+}
+
+// mod(a, b): ユークリッドの剰余です。
+// % とちがって、結果はいつも 0 <= mod(a, b) < |b| になります。
+//  -7 % 3 = -1  mod(-7, 3) = 2
+func euclidMod(e BinOp, l, r Ast, env *Env) Ast {
+	e.Op = "%"
+	m := calc(e, l, r, env)
+	if sign(m) >= 0 {
+		return m
+	}
+	if sign(r) < 0 {
+		e.Op = "-"
+	} else {
+		e.Op = "+"
+	}
+	return calc(e, m, r, env)
+}
+
+// powmod(b, e, m): b**e を m で割ったあまりです。
+// 整数だけで、大きな数でも途中の値をmで割りながら計算します。
+func powMod(b, x, m Ast, pos Pos, frag string) Ast {
+	for _, v := range []Ast{b, x, m} {
+		if !isInteger(v) {
+			panic(newError(TypeError, pos, "non-integer for powmod", frag))
+		}
+	}
+	if sign(x) < 0 {
+		panic(newError(ValueError, pos, "negative exponent", frag))
+	}
+	if sign(m) <= 0 {
+		panic(newError(ValueError, pos, "non-positive modulus", frag))
+	}
+	z := new(big.Int).Exp(toBig(b), toBig(x), toBig(m))
+	// bが負のときもmod()とおなじように0以上にします。
+	if z.Sign() < 0 {
+		z.Add(z, toBig(m))
+	}
+	return intResult(z)
+}
@@ -0,0 +1,134 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"big"
+	"fmt"
+)
+
+// 有理数(分数)をAstインターフェイスをみたすRational型として定義します。
+// 整数どうしの割り算の結果は、割り切れなければこの型になります。
+// big.Ratはいつも約分された状態になっています。
+type Rational struct {
+	*big.Rat
+}
+
+func (r Rational) Eval(_ *Env) Ast {
+	return r
+}
+
+// 数値を*big.Ratにします。
+func toRat(v Ast) *big.Rat {
+	switch n := v.(type) {
+	case Num, BigNum, Fixed:
+		return new(big.Rat).SetInt(toBig(n))
+	case Rational:
+		return n.Rat
+	case Decimal:
+		// Decimalは10進数の分数なので誤差なしに変換できます。
+		if n.Scale <= 0 {
+			x := new(big.Int).Mul(n.Unscaled, pow10(-n.Scale))
+			return new(big.Rat).SetInt(x)
+		}
+		return new(big.Rat).SetFrac(n.Unscaled, pow10(n.Scale))
+	}
+	panic(newError(TypeError, PosOf(v), "not rational", v.String()))
+}
+
+// 分母が1なら整数に、そうでなければRationalにします。
+func ratResult(x *big.Rat) Ast {
+	if x.IsInt() {
+		return intResult(new(big.Int).Set(x.Num()))
+	}
+	return Rational{x}
+}
+
+// big.Ratで計算します。
+func ratCalc(e BinOp, a, b *big.Rat) *big.Rat {
+	z := new(big.Rat)
+	switch e.Op {
+	case "+":
+		return z.Add(a, b)
+	case "-":
+		return z.Sub(a, b)
+	case "*":
+		return z.Mul(a, b)
+	case "/":
+		if b.Sign() == 0 {
+			panic(newError(DivisionError, e.Pos,
+				"division by zero", e.String()))
+		}
+		return z.Quo(a, b)
+	case "%":
+		if b.Sign() == 0 {
+			panic(newError(DivisionError, e.Pos,
+				"division by zero", e.String()))
+		}
+		// a - b*truncate(a/b)
+		q := z.Quo(a, b)
+		t := new(big.Rat).SetInt(roundQuo(q.Num(), q.Denom(), "down"))
+		return z.Sub(a, t.Mul(t, b))
+	}
+	panic(newError(TypeError, e.Pos,
+		fmt.Sprintf("unsupported binOp:%s", e.Op), e.String()))
+}
+
+// 数値でなければ、関数呼出のまま評価を先送りにします。
+// BinOpが未定義のSymbolをふくむときにBinOpのままかえすのとおなじです。
+// argsは評価したあとの引数です。
+func deferCall(name string, args ...Ast) Ast {
+	var pos Pos
+	if len(args) > 0 {
+		pos = PosOf(args[0])
+	}
+	return FunCall{Func: Symbol(name), Args: args, Pos: pos}
+}
+
+// num(x): xの分子をかえします。整数ならxそのものです。
+func numFunc(arg Ast, env *Env) Ast {
+	v := arg.Eval(env)
+	checkNumber("num", v)
+	if !isValue(v) {
+		return deferCall("num", v)
+	}
+	return intResult(new(big.Int).Set(toRat(v).Num()))
+}
+
+// den(x): xの分母をかえします。整数なら1です。
+func denFunc(arg Ast, env *Env) Ast {
+	v := arg.Eval(env)
+	checkNumber("den", v)
+	if !isValue(v) {
+		return deferCall("den", v)
+	}
+	return intResult(new(big.Int).Set(toRat(v).Denom()))
+}
+
+// Rationalを.printRationalの設定にしたがって文字列にします。
+//  fraction  4/3 (default)
+//  mixed     1 1/3
+//  decimal   1.3333333333 (小数点以下は.printDigits桁)
+func printRational(r Rational, env *Env) string {
+	mode := envSymbolOr(env, ".printRational", "fraction")
+	switch mode {
+	case "fraction":
+		return r.String()
+	case "mixed":
+		// 整数部分と、のこりの真分数にわけます。
+		// Quoは0の方向に切り捨てるので、符号は整数部分にだけつけます。
+		q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+		if q.Sign() == 0 {
+			return r.String()
+		}
+		return fmt.Sprintf("%s %s/%s", q, m.Abs(m), r.Denom())
+	case "decimal":
+		digits := envValueOr(env, ".printDigits", 10)
+		if digits < 0 {
+			panic(badSetting(env, ".printDigits"))
+		}
+		return r.FloatString(digits)
+	}
+	panic(badSetting(env, ".printRational"))
+}
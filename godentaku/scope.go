@@ -0,0 +1,130 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parentの子のスコープになるEnvを作ります。
+// 子のEnvのVarに設定した変数は子のEnvとその子孫からだけ見えて、
+// 親のおなじ名前の変数をかくします。見つからない変数は親のほうへ
+// さがしにいきます。
+// 関数(Func, FuncN, Def)は親と共有します。
+func NewChildEnv(parent *Env) *Env {
+	// 共有するmapがnilのままだと、子で作ったmapは親から見えません。
+	ensureMaps(parent)
+	return &Env{
+		Var:    make(map[string]Ast),
+		Func:   parent.Func,
+		FuncN:  parent.FuncN,
+		Def:    parent.Def,
+		Parent: parent,
+		depth:  parent.depth,
+	}
+}
+
+// 変数nameをenvから親のほうへさがします。
+// ownerは変数が見つかったEnvで、見つからなければnilです。
+func lookup(env *Env, name string) (v Ast, owner *Env) {
+	for e := env; e != nil; e = e.Parent {
+		if v, found := e.Var[name]; found {
+			return v, e
+		}
+	}
+	return nil, nil
+}
+
+// 一番親のEnvをかえします。
+func rootEnv(env *Env) *Env {
+	for env.Parent != nil {
+		env = env.Parent
+	}
+	return env
+}
+
+// どのEnvのどの変数かをあらわします。
+// 構造体もmapのキーに使えます。
+type varRef struct {
+	env  *Env
+	name string
+}
+
+// 評価ずみの値です。関数の引数や let でEnvに設定した値は、もう一度
+// 評価しないようにこれでつつみます。
+type Value struct {
+	Ast
+}
+
+func (v Value) Eval(_ *Env) Ast {
+	return v.Ast
+}
+
+// let式をAstインターフェイスをみたすLetExpr型として定義します。
+//  let x = 1, y = x + 1 in x * y
+// のように書くと、xとyはinのあとの式の中だけで使えます。
+// 外におなじ名前の変数があってもかわりません。
+type LetExpr struct {
+	Names []Symbol
+	Exprs []Ast
+	Body  Ast
+	Pos   Pos
+}
+
+func (l LetExpr) String() string {
+	binds := make([]string, len(l.Names))
+	for i, name := range l.Names {
+		binds[i] = fmt.Sprintf("%s = %s", name, l.Exprs[i])
+	}
+	return fmt.Sprintf("(let %s in %s)", strings.Join(binds, ", "), l.Body)
+}
+func (l LetExpr) Position() Pos {
+	return l.Pos
+}
+func (l LetExpr) Eval(env *Env) Ast {
+	scope := NewChildEnv(env)
+	// 前の変数は後の式から見えます。
+	for i, name := range l.Names {
+		scope.Var[string(name)] = Value{l.Exprs[i].Eval(scope)}
+	}
+	return l.Body.Eval(scope)
+}
+
+// 変数の参照の循環をあらわすエラーを作ります。
+// pathは循環のはじまりからの評価している途中の変数で、refでpathの
+// 最初に戻ります。
+//  cycle: a -> b -> a
+func cycleError(path []varRef, ref varRef) *Error {
+	names := make([]string, len(path)+1)
+	for i, r := range path {
+		names[i] = r.name
+	}
+	names[len(path)] = ref.name
+	return newError(CycleError, Pos{}, strings.Join(names, " -> "), "")
+}
+
+// 変数nameの種類をかえします。
+// x = y + 1 で代入した式なら"formula"、x := y + 1 で代入した値や
+// 関数の引数なら"value"、未定義なら""です。
+func VarKind(env *Env, name string) string {
+	v, owner := lookup(env, name)
+	if owner == nil {
+		return ""
+	}
+	if _, ok := v.(Value); ok {
+		return "value"
+	}
+	return "formula"
+}
+
+// varkind(x): 変数xが式(formula)か値(value)か。未定義ならundefined。
+// 引数は評価せずに変数の名前として使います。
+func varkindFunc(args []Ast, env *Env) Ast {
+	kind := VarKind(env, varName("varkind", args))
+	if kind == "" {
+		kind = "undefined"
+	}
+	return String(kind)
+}
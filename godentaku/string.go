@@ -0,0 +1,218 @@
+// Copyright 2010 Fumitoshi Ukai. ALl Rights reserved.
+// Use of this source code is governed by a BSD-style
+
+package godentaku
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"utf8"
+)
+
+// 文字列をAstインターフェイスをみたすString型として定義します。
+// "abc" のようにダブルクオートでかこんで書きます。"\n" や "\"" の
+// ようなエスケープはGoの文字列とおなじです。
+// Symbolは変数の名前ですが、Stringは評価してもかわらない値です。
+type String string
+
+// 式として表示するときはクオートします。
+// Print()ではクオートせずに中身をそのまま表示します。
+func (s String) String() string {
+	return strconv.Quote(string(s))
+}
+func (s String) Eval(_ *Env) Ast {
+	return s
+}
+
+// 文字列リテラルを読んでStringにします。
+// textは入力の "..." の部分そのままです。
+func stringLiteral(text string, pos Pos) String {
+	s, err := strconv.Unquote(text)
+	if err != nil {
+		panic(newError(SyntaxError, pos, "bad string literal", text))
+	}
+	return String(s)
+}
+
+// bufの先頭の "..." のバイト数をかえします。
+// 行の終わりまでに閉じていなければokはfalseです。
+func stringLen(buf []byte) (n int, ok bool) {
+	for n = 1; n < len(buf) && buf[n] != '"' && buf[n] != '\n'; n++ {
+		// \" は文字列の終わりではありません。
+		if buf[n] == '\\' && n+1 < len(buf) && buf[n+1] != '\n' {
+			n++
+		}
+	}
+	if n == len(buf) || buf[n] != '"' {
+		return n, false
+	}
+	return n + 1, true
+}
+
+// Stringをふくむ二項演算です。
+// "abc" + "def" で連結、==, < などで辞書順の比較ができます。
+// 数値とは計算できないので、数値を文字列にするには format() を
+// 使います。
+func stringCalc(e BinOp, l, r Ast) Ast {
+	a, lok := l.(String)
+	b, rok := r.(String)
+	if lok && rok {
+		switch e.Op {
+		case "+":
+			return a + b
+		case "==":
+			return Bool(a == b)
+		case "!=":
+			return Bool(a != b)
+		case "<":
+			return Bool(a < b)
+		case "<=":
+			return Bool(a <= b)
+		case ">":
+			return Bool(a > b)
+		case ">=":
+			return Bool(a >= b)
+		}
+	}
+	panic(newError(TypeError, e.Pos,
+		"unsupported binOp:"+e.Op, e.String()))
+}
+
+// 引数を評価します。未定義のSymbolをふくむときは、関数呼出のまま
+// 評価を先送りにするので、deferredにそのAstをかえします。
+func valueArgs(name string, args []Ast, min, max int, env *Env) (vals []Ast, deferred Ast) {
+	checkArgs(name, args, min, max)
+	vals = make([]Ast, len(args))
+	value := true
+	for i, arg := range args {
+		vals[i] = arg.Eval(env)
+		value = value && isValue(vals[i])
+	}
+	if !value {
+		return nil, deferCall(name, vals...)
+	}
+	return vals, nil
+}
+
+// 引数iがStringか調べます。
+func stringArg(name string, args []Ast, i int) string {
+	s, ok := args[i].(String)
+	if !ok {
+		panic(newError(TypeError, Pos{}, name+": not string",
+			args[i].String()))
+	}
+	return string(s)
+}
+
+// 引数iが整数か調べます。
+func intArg(name string, args []Ast, i int) int {
+	n, ok := args[i].(Num)
+	if !ok {
+		panic(newError(TypeError, Pos{}, name+": not integer",
+			args[i].String()))
+	}
+	return int(n)
+}
+
+// len(s): 文字列の文字数か、リストの要素の数
+//  len("日本語") = 3
+func lenFunc(args []Ast, env *Env) Ast {
+	vals, deferred := valueArgs("len", args, 1, 1, env)
+	if deferred != nil {
+		return deferred
+	}
+	if l, ok := vals[0].(List); ok {
+		return Num(len(l))
+	}
+	return Num(utf8.RuneCountInString(stringArg("len", vals, 0)))
+}
+
+// substr(s, start): startの文字から最後まで
+// substr(s, start, n): startの文字からn文字
+// 位置は0からはじまる文字の数です。
+//  substr("godentaku", 2, 4) = "dent"
+func substrFunc(args []Ast, env *Env) Ast {
+	vals, deferred := valueArgs("substr", args, 2, 3, env)
+	if deferred != nil {
+		return deferred
+	}
+	s := stringArg("substr", vals, 0)
+	count := utf8.RuneCountInString(s)
+	start := intArg("substr", vals, 1)
+	end := count
+	if len(vals) == 3 {
+		end = start + intArg("substr", vals, 2)
+	}
+	if start < 0 || end < start || end > count {
+		panic(newError(ValueError, Pos{}, "substr: out of range",
+			deferCall("substr", vals...).String()))
+	}
+	// rangeで文字列をまわすと、文字ごとにバイトの位置がとれます。
+	var from, to, i int
+	to = len(s)
+	for off := range s {
+		if i == start {
+			from = off
+		}
+		if i == end {
+			to = off
+		}
+		i++
+	}
+	if start == count {
+		from = len(s)
+	}
+	return String(s[from:to])
+}
+
+// upper(s): 大文字にした文字列
+func upperFunc(args []Ast, env *Env) Ast {
+	vals, deferred := valueArgs("upper", args, 1, 1, env)
+	if deferred != nil {
+		return deferred
+	}
+	return String(strings.ToUpper(stringArg("upper", vals, 0)))
+}
+
+// lower(s): 小文字にした文字列
+func lowerFunc(args []Ast, env *Env) Ast {
+	vals, deferred := valueArgs("lower", args, 1, 1, env)
+	if deferred != nil {
+		return deferred
+	}
+	return String(strings.ToLower(stringArg("lower", vals, 0)))
+}
+
+// format(fmt, args...): fmt.Sprintf()とおなじ書式で文字列を作ります。
+// 整数、Float、String、BoolはそのままGoの値としてわたすので %d や
+// %.2f が使えます。大きな整数は*big.Intに、DecimalとRationalは
+// float64にしてわたします。そのほかの値はPrint()した文字列になります。
+//  format("%s: %5.1f%%", "rate", 12.345) = "rate:  12.3%"
+func formatFunc(args []Ast, env *Env) Ast {
+	vals, deferred := valueArgs("format", args, 1, -1, env)
+	if deferred != nil {
+		return deferred
+	}
+	format := stringArg("format", vals, 0)
+	a := make([]interface{}, len(vals)-1)
+	for i, v := range vals[1:] {
+		switch v := v.(type) {
+		case Num:
+			a[i] = int64(v)
+		case BigNum, Fixed:
+			a[i] = toBig(v)
+		case Float:
+			a[i] = float64(v)
+		case Decimal, Rational:
+			a[i] = toFloat(v)
+		case String:
+			a[i] = string(v)
+		case Bool:
+			a[i] = bool(v)
+		default:
+			a[i] = Print(v, env)
+		}
+	}
+	return String(fmt.Sprintf(format, a...))
+}